@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log"
+	"math"
+	"os"
+)
+
+var (
+	mpegBitRates = map[int][]int{
+		0x13: {0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448},
+		0x12: {0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},
+		0x11: {0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+		0x23: {0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+		0x22: {0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+		0x21: {0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+	}
+	mpegSampleRates = map[byte][]int{3: {44100, 48000, 32000}, 2: {22050, 24000, 16000}, 0: {11025, 12000, 8000}}
+	adtsSampleRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+	asfHeaderGuid   = []byte{0x30, 0x26, 0xb2, 0x75, 0x8e, 0x66, 0xcf, 0x11, 0xa6, 0xd9, 0x00, 0xaa, 0x00, 0x62, 0xce, 0x6c}
+	asfFileGuid     = []byte{0xa1, 0xdc, 0xab, 0x8c, 0x47, 0xa9, 0xcf, 0x11, 0x8e, 0xe4, 0x00, 0xc0, 0x0c, 0x20, 0x53, 0x65}
+)
+
+type mpegFrame struct {
+	length     int
+	samples    int
+	sampleRate int
+	sideInfo   int
+	adts       bool
+}
+
+// ReadAudioProperties returns the duration and the average bitrate of the audio stream
+func ReadAudioProperties(filename string) *Tags {
+	file := ProcessErrorArg(os.Open(filename)).(*os.File)
+	defer Close(file)
+	properties, err := readAudioProperties(file)
+	if err != nil {
+		log.Printf("Unable to read the audio properties of %s: %v\n", filename, err)
+	}
+	return properties
+}
+
+func readAudioProperties(reader io.ReadSeeker) (*Tags, error) {
+	var (
+		offset int64
+		header = make([]byte, 16)
+	)
+	size, err := reader.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	} else if _, err := reader.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	} else if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, nil
+	}
+	if bytes.HasPrefix(header, []byte("ID3")) {
+		if offset = int64(10 + syncsafeInt(header[6:10])); header[5]&0x10 != 0 {
+			offset += 10
+		}
+		if _, err := reader.Seek(offset, io.SeekStart); err != nil {
+			return nil, err
+		} else if _, err := io.ReadFull(reader, header); err != nil {
+			return nil, nil
+		}
+	}
+	var (
+		duration  float64
+		audioSize = size - offset
+	)
+	switch {
+	case bytes.HasPrefix(header, []byte("fLaC")):
+		duration, err = readFlacDuration(reader, offset)
+	case bytes.HasPrefix(header, []byte("OggS")):
+		duration, err = readOggDuration(reader, offset, size)
+	case bytes.Equal(header[4:8], []byte("ftyp")):
+		duration, audioSize, err = readMP4Duration(reader, size)
+	case bytes.HasPrefix(header, []byte("RIFF")) && bytes.Equal(header[8:12], []byte("WAVE")):
+		return readWavProperties(reader, size)
+	case bytes.HasPrefix(header, asfHeaderGuid):
+		duration, err = readASFDuration(reader, size)
+	default:
+		duration, audioSize, err = readMPEGDuration(reader, offset, size)
+	}
+	if err != nil || duration <= 0 {
+		return nil, err
+	}
+	return &Tags{
+		Duration: int(math.Round(duration)),
+		BitRate:  int(math.Round(float64(audioSize) * 8 / duration / 1000)),
+	}, nil
+}
+
+// readMPEGDuration handles MPEG audio (with Xing/Info/VBRI header or by scanning the frames) and ADTS AAC streams
+func readMPEGDuration(reader io.ReadSeeker, offset, size int64) (float64, int64, error) {
+	if _, err := reader.Seek(offset, io.SeekStart); err != nil {
+		return 0, 0, err
+	}
+	bufferedReader := bufio.NewReaderSize(reader, 1<<16)
+	var first mpegFrame
+	for skipped := 0; ; skipped++ {
+		if skipped > 1<<16 {
+			return 0, 0, nil
+		}
+		if header, err := bufferedReader.Peek(7); err != nil {
+			return 0, 0, nil
+		} else if frame, ok := parseMPEGFrameHeader(header); ok {
+			if next, err := bufferedReader.Peek(frame.length + 7); err == nil {
+				if nextFrame, ok := parseMPEGFrameHeader(next[frame.length:]); ok && nextFrame.adts == frame.adts {
+					first = frame
+					break
+				}
+			}
+		}
+		ProcessErrorArg(bufferedReader.Discard(1))
+		offset++
+	}
+	if !first.adts {
+		if data, err := bufferedReader.Peek(first.length); err == nil {
+			if frames, audioSize := readMPEGVbrHeader(data, first); frames > 0 {
+				if audioSize <= 0 {
+					audioSize = size - offset
+				}
+				return float64(frames*first.samples) / float64(first.sampleRate), audioSize, nil
+			}
+		}
+	}
+	var samples, audioSize int64
+	for resync := 0; resync < 4096; {
+		header, err := bufferedReader.Peek(7)
+		if err != nil && len(header) < 4 {
+			break
+		}
+		if frame, ok := parseMPEGFrameHeader(header); ok && frame.adts == first.adts {
+			if _, err := bufferedReader.Discard(frame.length); err != nil {
+				break
+			}
+			samples, audioSize, resync = samples+int64(frame.samples), audioSize+int64(frame.length), 0
+		} else if _, err := bufferedReader.Discard(1); err != nil {
+			break
+		} else {
+			resync++
+		}
+	}
+	return float64(samples) / float64(first.sampleRate), audioSize, nil
+}
+
+// parseMPEGFrameHeader parses the header of an MPEG audio (4 bytes) or an ADTS (7 bytes) frame
+func parseMPEGFrameHeader(header []byte) (mpegFrame, bool) {
+	if len(header) < 4 || header[0] != 0xff || header[1]&0xe0 != 0xe0 {
+		return mpegFrame{}, false
+	}
+	version, layer := (header[1]>>3)&0x03, (header[1]>>1)&0x03
+	if layer == 0 {
+		if len(header) < 7 || version&0x02 == 0 {
+			return mpegFrame{}, false
+		}
+		sampleRateIndex := int(header[2]>>2) & 0x0f
+		length := int(header[3]&0x03)<<11 | int(header[4])<<3 | int(header[5]>>5)
+		if sampleRateIndex >= len(adtsSampleRates) || length < 7 {
+			return mpegFrame{}, false
+		}
+		return mpegFrame{
+			length:     length,
+			samples:    (int(header[6]&0x03) + 1) * 1024,
+			sampleRate: adtsSampleRates[sampleRateIndex],
+			adts:       true,
+		}, true
+	}
+	bitRateIndex, sampleRateIndex := int(header[2]>>4), int(header[2]>>2)&0x03
+	if version == 1 || bitRateIndex == 0 || bitRateIndex == 15 || sampleRateIndex == 3 {
+		return mpegFrame{}, false
+	}
+	tableVersion := 0x20
+	if version == 3 {
+		tableVersion = 0x10
+	}
+	frame := mpegFrame{
+		sampleRate: mpegSampleRates[version][sampleRateIndex],
+		sideInfo:   32,
+	}
+	bitRate := mpegBitRates[tableVersion|int(layer)][bitRateIndex] * 1000
+	padding, mono := int(header[2]>>1)&0x01, header[3]>>6 == 3
+	switch {
+	case layer == 3:
+		frame.samples = 384
+		frame.length = (12*bitRate/frame.sampleRate + padding) * 4
+	case layer == 2 || version == 3:
+		frame.samples = 1152
+		frame.length = 144*bitRate/frame.sampleRate + padding
+	default:
+		frame.samples = 576
+		frame.length = 72*bitRate/frame.sampleRate + padding
+	}
+	if version != 3 && mono {
+		frame.sideInfo = 9
+	} else if version != 3 || mono {
+		frame.sideInfo = 17
+	}
+	return frame, frame.length >= 4
+}
+
+// readMPEGVbrHeader returns the frame count and the stream size stored in the Xing/Info or VBRI header
+func readMPEGVbrHeader(data []byte, frame mpegFrame) (int, int64) {
+	if xing := data[Min(4+frame.sideInfo, len(data)):]; len(xing) >= 16 &&
+		(bytes.HasPrefix(xing, []byte("Xing")) || bytes.HasPrefix(xing, []byte("Info"))) {
+		flags, pos := binary.BigEndian.Uint32(xing[4:]), 8
+		var frames int
+		var audioSize int64
+		if flags&0x01 != 0 {
+			frames, pos = int(binary.BigEndian.Uint32(xing[pos:])), pos+4
+		}
+		if flags&0x02 != 0 {
+			audioSize = int64(binary.BigEndian.Uint32(xing[pos:]))
+		}
+		return frames, audioSize
+	}
+	if vbri := data[Min(36, len(data)):]; len(vbri) >= 18 && bytes.HasPrefix(vbri, []byte("VBRI")) {
+		return int(binary.BigEndian.Uint32(vbri[14:])), int64(binary.BigEndian.Uint32(vbri[10:]))
+	}
+	return 0, 0
+}
+
+func readFlacDuration(reader io.ReadSeeker, offset int64) (float64, error) {
+	var duration float64
+	err := forEachFlacMetadataBlock(reader, offset, func(blockType byte, length int) error {
+		if blockType == 0 && length >= 18 {
+			streamInfo := make([]byte, 18)
+			if _, err := io.ReadFull(reader, streamInfo); err != nil {
+				return err
+			}
+			duration = flacStreamInfoDuration(streamInfo)
+		}
+		return nil
+	})
+	return duration, err
+}
+
+func flacStreamInfoDuration(streamInfo []byte) float64 {
+	sampleRate := int(streamInfo[10])<<12 | int(streamInfo[11])<<4 | int(streamInfo[12]>>4)
+	totalSamples := int64(streamInfo[13]&0x0f)<<32 | int64(binary.BigEndian.Uint32(streamInfo[14:]))
+	if sampleRate == 0 {
+		return 0
+	}
+	return float64(totalSamples) / float64(sampleRate)
+}
+
+// readOggDuration divides the granule position of the last page by the sample rate of the stream
+func readOggDuration(reader io.ReadSeeker, offset, size int64) (float64, error) {
+	packets, err := readOggPackets(reader, offset, 1)
+	if err != nil || len(packets) == 0 {
+		return 0, err
+	}
+	var (
+		identification = packets[0]
+		sampleRate     int
+		preSkip        int64
+	)
+	switch {
+	case bytes.HasPrefix(identification, []byte("\x01vorbis")) && len(identification) >= 16:
+		sampleRate = int(binary.LittleEndian.Uint32(identification[12:]))
+	case bytes.HasPrefix(identification, []byte("OpusHead")) && len(identification) >= 12:
+		sampleRate, preSkip = 48000, int64(binary.LittleEndian.Uint16(identification[10:]))
+	case bytes.HasPrefix(identification, []byte("\x7fFLAC")) && len(identification) >= 13+4+18:
+		return flacStreamInfoDuration(identification[13+4:]), nil
+	default:
+		return 0, nil
+	}
+	header := make([]byte, 27)
+	if _, err := reader.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	} else if _, err := io.ReadFull(reader, header); err != nil {
+		return 0, err
+	}
+	serial := binary.LittleEndian.Uint32(header[14:])
+	tail := make([]byte, Min(int(size-offset), 1<<16))
+	if _, err := reader.Seek(size-int64(len(tail)), io.SeekStart); err != nil {
+		return 0, err
+	} else if _, err := io.ReadFull(reader, tail); err != nil {
+		return 0, err
+	}
+	for pos := bytes.LastIndex(tail, []byte("OggS")); pos >= 0; pos = bytes.LastIndex(tail[:pos], []byte("OggS")) {
+		if pos+27 <= len(tail) && binary.LittleEndian.Uint32(tail[pos+14:]) == serial {
+			if granule := int64(binary.LittleEndian.Uint64(tail[pos+6:])); granule > 0 && sampleRate > 0 {
+				return float64(granule-preSkip) / float64(sampleRate), nil
+			}
+		}
+	}
+	return 0, nil
+}
+
+// readMP4Duration reads the duration from the mvhd box, or from the mdhd box of the first track
+func readMP4Duration(reader io.ReadSeeker, size int64) (float64, int64, error) {
+	var duration float64
+	readHeaderDuration := func(start, end int64) error {
+		if end-start < 20 {
+			return NewError("invalid MP4 header box")
+		}
+		header := make([]byte, Min(int(end-start), 32))
+		if _, err := reader.Seek(start, io.SeekStart); err != nil {
+			return err
+		} else if _, err := io.ReadFull(reader, header); err != nil {
+			return err
+		}
+		if header[0] == 1 && len(header) >= 32 {
+			if timeScale := binary.BigEndian.Uint32(header[20:]); timeScale > 0 {
+				duration = float64(binary.BigEndian.Uint64(header[24:])) / float64(timeScale)
+			}
+		} else if timeScale := binary.BigEndian.Uint32(header[12:]); timeScale > 0 {
+			duration = float64(binary.BigEndian.Uint32(header[16:])) / float64(timeScale)
+		}
+		return nil
+	}
+	if start, end, err := findMP4Box(reader, 0, size, "moov", "mvhd"); err != nil {
+		return 0, 0, err
+	} else if end > 0 {
+		if err := readHeaderDuration(start, end); err != nil {
+			return 0, 0, err
+		}
+	}
+	if duration <= 0 {
+		if start, end, err := findMP4Box(reader, 0, size, "moov", "trak", "mdia", "mdhd"); err != nil {
+			return 0, 0, err
+		} else if end > 0 {
+			if err := readHeaderDuration(start, end); err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+	audioSize := size
+	if start, end, err := findMP4Box(reader, 0, size, "mdat"); err == nil && end > start {
+		audioSize = end - start
+	}
+	return duration, audioSize, nil
+}
+
+// readWavProperties reads the byte rate from the fmt chunk and the size of the data chunk
+func readWavProperties(reader io.ReadSeeker, size int64) (*Tags, error) {
+	var (
+		byteRate int64
+		dataSize int64
+		header   = make([]byte, 8)
+	)
+	for pos := int64(12); pos+8 <= size; {
+		if _, err := reader.Seek(pos, io.SeekStart); err != nil {
+			return nil, err
+		} else if _, err := io.ReadFull(reader, header); err != nil {
+			return nil, err
+		}
+		chunkSize := int64(binary.LittleEndian.Uint32(header[4:]))
+		switch string(header[:4]) {
+		case "fmt ":
+			format := make([]byte, 12)
+			if _, err := io.ReadFull(reader, format); err != nil {
+				return nil, err
+			}
+			byteRate = int64(binary.LittleEndian.Uint32(format[8:]))
+		case "data":
+			if dataSize = chunkSize; dataSize > size-pos-8 {
+				dataSize = size - pos - 8
+			}
+		}
+		pos += 8 + chunkSize + chunkSize%2
+	}
+	if byteRate == 0 || dataSize == 0 {
+		return nil, nil
+	}
+	return &Tags{
+		Duration: int(math.Round(float64(dataSize) / float64(byteRate))),
+		BitRate:  int(byteRate * 8 / 1000),
+	}, nil
+}
+
+// readASFDuration reads the play duration of the ASF file properties object of WMA files
+func readASFDuration(reader io.ReadSeeker, size int64) (float64, error) {
+	header := make([]byte, 24)
+	for pos := int64(30); pos+24 <= size; {
+		if _, err := reader.Seek(pos, io.SeekStart); err != nil {
+			return 0, err
+		} else if _, err := io.ReadFull(reader, header); err != nil {
+			return 0, err
+		}
+		objectSize := int64(binary.LittleEndian.Uint64(header[16:]))
+		if objectSize < 24 {
+			return 0, NewError("invalid ASF object")
+		}
+		if bytes.Equal(header[:16], asfFileGuid) && objectSize >= 104 {
+			fileProperties := make([]byte, 80)
+			if _, err := io.ReadFull(reader, fileProperties); err != nil {
+				return 0, err
+			}
+			playDuration := float64(binary.LittleEndian.Uint64(fileProperties[40:])) / 1e7
+			preroll := float64(binary.LittleEndian.Uint64(fileProperties[56:])) / 1e3
+			return playDuration - preroll, nil
+		}
+		pos += objectSize
+	}
+	return 0, nil
+}
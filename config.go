@@ -17,16 +17,26 @@ var (
 		Server: &ServerConfig{
 			ListenAddress: ":4040",
 		},
+		StateFolder:      "/var/lib/simplesonic",
+		IgnoredArticles:  "The El La Los Die",
+		CoverFiles:       []string{"folder.*", "cover.*", "front.*", "albumart*.*"},
+		ArtistImageFiles: []string{"artist.*"},
 	}
 	Config = configDefaultValues.readConfigFile()
 )
 
 type SimplesonicConfig struct {
-	Server         *ServerConfig        `json:"server"`
-	MusicFolders   []*MusicFolderConfig `json:"musicFolders"`
-	PlaylistFolder string               `json:"playlistFolder"`
-	Users          []*UserConfig        `json:"users"`
-	MPD            *MPDConfig           `json:"mpd"`
+	Server           *ServerConfig        `json:"server"`
+	MusicFolders     []*MusicFolderConfig `json:"musicFolders"`
+	PlaylistFolder   string               `json:"playlistFolder"`
+	StateFolder      string               `json:"stateFolder"`
+	IgnoredArticles  string               `json:"ignoredArticles"`
+	Users            []*UserConfig        `json:"users"`
+	MPD              *MPDConfig           `json:"mpd"`
+	TagsPrecedence   []string             `json:"tagsPrecedence"`
+	Transcodings     []*TranscodingConfig `json:"transcodings"`
+	CoverFiles       []string             `json:"coverFiles"`
+	ArtistImageFiles []string             `json:"artistImageFiles"`
 }
 
 type ServerConfig struct {
@@ -36,17 +46,51 @@ type ServerConfig struct {
 }
 
 type MusicFolderConfig struct {
-	Name string `json:"name"`
-	Path string `json:"path"`
+	Name   string `json:"name"`
+	Path   string `json:"path"`
+	Layout string `json:"layout"`
+	layout *Layout
 }
 
 type UserConfig struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
+	Username     string             `json:"username"`
+	Password     string             `json:"password"`
+	MaxBitRate   int                `json:"maxBitRate"`
+	Scrobblers   []*ScrobblerConfig `json:"scrobblers"`
+	MPDPartition string             `json:"mpdPartition"`
+}
+
+type ScrobblerConfig struct {
+	Type       string `json:"type"`
+	Url        string `json:"url"`
+	Token      string `json:"token"`
+	ApiKey     string `json:"apiKey"`
+	ApiSecret  string `json:"apiSecret"`
+	SessionKey string `json:"sessionKey"`
+}
+
+type TranscodingConfig struct {
+	From    []string `json:"from"`
+	Format  string   `json:"format"`
+	BitRate int      `json:"bitRate"`
+	Command []string `json:"command"`
 }
 
 type MPDConfig struct {
-	UnixSocket string `json:"unixSocket"`
+	Address        string `json:"address"`
+	UnixSocket     string `json:"unixSocket"`
+	Password       string `json:"password"`
+	Partition      string `json:"partition"`
+	MusicDirectory string `json:"musicDirectory"`
+}
+
+func GetUserConfig(username string) *UserConfig {
+	for _, user := range Config.Users {
+		if user.Username == username {
+			return user
+		}
+	}
+	return &UserConfig{Username: username}
 }
 
 func (config *SimplesonicConfig) readConfigFile() *SimplesonicConfig {
@@ -64,6 +108,54 @@ func (config *SimplesonicConfig) readConfigFile() *SimplesonicConfig {
 	file := ProcessErrorArg(os.Open(configFile)).(*os.File)
 	defer Close(file)
 	ProcessError(json.NewDecoder(file).Decode(&config))
+	for _, transcoding := range config.Transcodings {
+		if len(transcoding.Command) == 0 {
+			ProcessErrorArg(fmt.Fprintf(os.Stderr, "Transcoding command is missing: %s\n", transcoding.Format))
+			os.Exit(1)
+		}
+	}
+	for _, musicFolder := range config.MusicFolders {
+		if musicFolder.Layout == "" {
+			continue
+		} else if layout, err := ParseLayout(musicFolder.Layout); err != nil {
+			ProcessErrorArg(fmt.Fprintf(os.Stderr, "Invalid music folder layout: %v\n", err))
+			os.Exit(1)
+		} else {
+			musicFolder.layout = layout
+		}
+	}
+	if len(config.TagsPrecedence) == 0 {
+		config.TagsPrecedence = tagsSources
+	}
+	for _, source := range config.TagsPrecedence {
+		if !Contains(source, tagsSources...) {
+			ProcessErrorArg(fmt.Fprintf(os.Stderr, "Unknown tags source: %s (expected one of %s)\n",
+				source, strings.Join(tagsSources, ", ")))
+			os.Exit(1)
+		}
+	}
+	for _, pattern := range append(config.CoverFiles, config.ArtistImageFiles...) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			ProcessErrorArg(fmt.Fprintf(os.Stderr, "Invalid cover file pattern: %s\n", pattern))
+			os.Exit(1)
+		}
+	}
+	if config.MPD != nil && config.MPD.Address == "" {
+		config.MPD.Address = config.MPD.UnixSocket
+	}
+	if config.MPD != nil && config.MPD.MusicDirectory == "" && len(config.MusicFolders) > 0 {
+		config.MPD.MusicDirectory = config.MusicFolders[0].Path
+	}
+	for _, user := range config.Users {
+		for _, scrobbler := range user.Scrobblers {
+			if defaultUrl, ok := scrobblerDefaultUrls[scrobbler.Type]; !ok {
+				ProcessErrorArg(fmt.Fprintf(os.Stderr, "Unknown scrobbler type: %s\n", scrobbler.Type))
+				os.Exit(1)
+			} else if scrobbler.Url == "" {
+				scrobbler.Url = defaultUrl
+			}
+		}
+	}
 	if config.Server.TLSKey != "" && !IsExists(config.Server.TLSKey) {
 		if tlsKey := filepath.Join(filepath.Dir(configFile), config.Server.TLSKey); IsExists(tlsKey) {
 			config.Server.TLSKey = tlsKey
@@ -1,18 +1,33 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
 	"image"
 	"image/color"
 	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"log"
 	"math"
+	"net/http"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
-type Interpolation int
-
 const (
-	NearestNeighbor Interpolation = iota
-	Bilinear
+	// coverCacheFolder is the folder of the resized covers in the state folder
+	coverCacheFolder = "covers"
+	coverJpegQuality = 90
+	// maxCoverSize limits the requested cover sizes, as the resized image is held in memory uncompressed
+	maxCoverSize = 1200
 )
 
 var (
@@ -25,17 +40,136 @@ var (
 	red         = color.RGBA{R: 255, G: 68, B: 68, A: 255}
 	purple      = color.RGBA{R: 170, G: 102, B: 204, A: 255}
 	coverColors = []color.RGBA{blue, green, orange, red, purple}
+	// coverImageExtensions are the extensions of the image files found as covers
+	coverImageExtensions = []string{".jpg", ".jpeg", ".png", ".gif", ".webp"}
+	// coverFileExtensions are the extensions of the resized covers by the content type of the source; the GIF
+	// covers are resized to PNG files, the WebP covers are cached as they are for the lack of a WebP decoder
+	coverFileExtensions = map[string]string{
+		"image/jpeg": ".jpg", "image/png": ".png", "image/gif": ".png", "image/webp": ".webp",
+	}
+	// coverFolders are the image files of the folders by their paths, read once per folder change
+	coverFolders      = make(map[string]*coverFolder)
+	coverFoldersMutex = sync.RWMutex{}
 )
 
+// coverFolder holds the sorted names of the image files of a folder and the mtime of the folder when read
+type coverFolder struct {
+	modTime time.Time
+	names   []string
+}
+
+// GenerateCover draws a cover with a colour picked by the text, and the text written in the gradient band
 func GenerateCover(text string) image.Image {
 	cover := image.NewNRGBA(image.Rect(0, 0, 600, 600))
 	coverColor := coverColors[int64(Hash(text))%int64(len(coverColors))]
 	draw.Draw(cover, cover.Bounds(), &image.Uniform{C: white}, image.Point{}, draw.Src)
 	draw.Draw(cover, image.Rect(12, 12, 588, 400), &image.Uniform{C: coverColor}, image.Point{}, draw.Src)
 	verticalGradient(cover, image.Rect(12, 400, 588, 588), grey, black)
+	DrawText(cover, image.Rect(36, 416, 564, 572), text, white)
 	return cover
 }
 
+// PlaylistCover returns the #EXTIMG image of the playlist (preferring the front cover), a mosaic of the covers
+// of the first four albums of its songs, the cover of its only album, or a cover generated with its name,
+// with its content type; the album covers which can not be read are skipped
+func PlaylistCover(playlist *ExtendedPlaylistWithSongs) ([]byte, string) {
+	if playlistImage := playlistImage(playlist); playlistImage != "" {
+		return ReadCover(playlistImage)
+	}
+	var firstCover string
+	var tiles []image.Image
+	for _, cover := range playlistAlbumCovers(playlist) {
+		if len(tiles) == 4 {
+			break
+		} else if tile := coverTile(cover); tile != nil {
+			if firstCover == "" {
+				firstCover = cover
+			}
+			tiles = append(tiles, tile)
+		}
+	}
+	switch {
+	case len(tiles) == 4:
+		mosaic := image.NewNRGBA(image.Rect(0, 0, 600, 600))
+		for i, tile := range tiles {
+			draw.Draw(mosaic, image.Rect(0, 0, 300, 300).Add(image.Pt(i%2*300, i/2*300)), tile, image.Point{}, draw.Src)
+		}
+		return EncodeCover(mosaic, "image/jpeg"), "image/jpeg"
+	case firstCover != "":
+		return ReadCover(firstCover)
+	}
+	return EncodeCover(GenerateCover(playlist.Name), "image/png"), "image/png"
+}
+
+// playlistImage returns the local #EXTIMG image of the playlist, preferring the front cover
+func playlistImage(playlist *ExtendedPlaylistWithSongs) string {
+	imageTypes := make([]string, 0, len(playlist.Images))
+	for imageType := range playlist.Images {
+		imageTypes = append(imageTypes, imageType)
+	}
+	sort.Slice(imageTypes, func(i, j int) bool {
+		frontI := strings.Contains(strings.ToLower(imageTypes[i]), "front")
+		frontJ := strings.Contains(strings.ToLower(imageTypes[j]), "front")
+		if frontI != frontJ {
+			return frontI
+		}
+		return imageTypes[i] < imageTypes[j]
+	})
+	for _, imageType := range imageTypes {
+		if !strings.HasPrefix(playlist.Images[imageType], "http://") &&
+			!strings.HasPrefix(playlist.Images[imageType], "https://") {
+			return playlist.Images[imageType]
+		}
+	}
+	return ""
+}
+
+// playlistAlbumCovers returns the cover art files of the distinct albums of the songs of the playlist
+func playlistAlbumCovers(playlist *ExtendedPlaylistWithSongs) []string {
+	var covers []string
+	albums := make(map[string]bool)
+	for _, entry := range playlist.Entry {
+		album := entry.AlbumId
+		if album == "" {
+			album = entry.CoverArt
+		}
+		if entry.CoverArt != "" && !albums[album] {
+			albums[album] = true
+			covers = append(covers, DecodeId(entry.CoverArt))
+		}
+	}
+	return covers
+}
+
+// coverTile returns the cover cropped and resized to a tile of the mosaic, or nil if it can not be decoded (WebP)
+func coverTile(filename string) (tile image.Image) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("Cover %s is left out of the mosaic: %v\n", filename, p)
+			tile = nil
+		}
+	}()
+	data, contentType := ReadCover(filename)
+	if contentType == "image/webp" {
+		return nil
+	}
+	return ResizeImage(squareImage(DecodeImage(data)), 300)
+}
+
+// squareImage crops the center square of the image
+func squareImage(img image.Image) image.Image {
+	bounds := img.Bounds()
+	size := Min(bounds.Dx(), bounds.Dy())
+	square := image.Rect(0, 0, size, size).Add(bounds.Min).Add(
+		image.Pt((bounds.Dx()-size)/2, (bounds.Dy()-size)/2))
+	if subImage, ok := img.(interface {
+		SubImage(image.Rectangle) image.Image
+	}); ok {
+		return subImage.SubImage(square)
+	}
+	return img
+}
+
 func verticalGradient(img *image.NRGBA, rect image.Rectangle, fromColor, toColor color.RGBA) {
 	for x := 0; x < rect.Dx(); x++ {
 		for y := 0; y < rect.Dy(); y++ {
@@ -50,54 +184,272 @@ func verticalGradient(img *image.NRGBA, rect image.Rectangle, fromColor, toColor
 	}
 }
 
-func OpenImage(filename string) image.Image {
-	file := ProcessErrorArg(os.Open(filename)).(*os.File)
-	defer Close(file)
-	img, _, err := image.Decode(file)
+func DecodeImage(data []byte) image.Image {
+	img, _, err := image.Decode(bytes.NewReader(data))
 	ProcessError(err)
 	return img
 }
 
-func ResizeImage(source image.Image, scale float64, interpolation Interpolation) image.Image {
-	width, height := int(float64(source.Bounds().Dx())*scale), int(float64(source.Bounds().Dy())*scale)
-	target := image.NewNRGBA(image.Rect(0, 0, width, height))
-	for x := 0; x < width; x++ {
-		for y := 0; y < height; y++ {
-			switch interpolation {
-			case NearestNeighbor:
-				target.Set(x, y, nearestNeighborInterpolation(source, float64(x)/scale, float64(y)/scale))
-			case Bilinear:
-				target.Set(x, y, bilinearInterpolation(source, float64(x)/scale, float64(y)/scale))
+// EncodeCover encodes the image as a PNG file for the PNG and GIF content types, otherwise as a JPEG file
+func EncodeCover(img image.Image, contentType string) []byte {
+	var buffer bytes.Buffer
+	if coverFileExtensions[contentType] == ".png" {
+		ProcessError(png.Encode(&buffer, img))
+	} else {
+		ProcessError(jpeg.Encode(&buffer, img, &jpeg.Options{Quality: coverJpegQuality}))
+	}
+	return buffer.Bytes()
+}
+
+// ReadCover returns the image file, the picture embedded in the media file or the cover of the playlist
+// in its original format, with its content type
+func ReadCover(filename string) ([]byte, string) {
+	var data []byte
+	if Contains(filepath.Ext(filename), mediaFileExtensions...) {
+		data = ReadCoverArt(filename)
+	} else if Contains(filepath.Ext(filename), playlistFileExtensions...) {
+		return PlaylistCover(ReadPlaylist(filename))
+	} else {
+		data = ProcessErrorArg(ioutil.ReadFile(filename)).([]byte)
+	}
+	return data, http.DetectContentType(data)
+}
+
+// FindCoverFile returns the first image file of the folder matching the patterns, in the order of the patterns;
+// the names are matched case-insensitively
+func FindCoverFile(directory string, patterns []string) string {
+	names := coverImageNames(directory)
+	for _, pattern := range patterns {
+		for _, name := range names {
+			if matched, _ := filepath.Match(strings.ToLower(pattern), strings.ToLower(name)); matched {
+				return filepath.Join(directory, name)
+			}
+		}
+	}
+	return ""
+}
+
+// coverImageNames returns the sorted names of the image files of the folder, reading the folder again only
+// when its mtime has changed, so the songs of an album share one read
+func coverImageNames(directory string) []string {
+	fileInfo, err := os.Stat(directory)
+	if err != nil {
+		return nil
+	}
+	coverFoldersMutex.RLock()
+	folder, ok := coverFolders[directory]
+	coverFoldersMutex.RUnlock()
+	if ok && folder.modTime.Equal(fileInfo.ModTime()) {
+		return folder.names
+	}
+	file, err := os.Open(directory)
+	if err != nil {
+		return nil
+	}
+	defer Close(file)
+	names, _ := file.Readdirnames(-1)
+	folder = &coverFolder{modTime: fileInfo.ModTime()}
+	for _, name := range names {
+		if Contains(strings.ToLower(filepath.Ext(name)), coverImageExtensions...) {
+			folder.names = append(folder.names, name)
+		}
+	}
+	sort.Strings(folder.names)
+	coverFoldersMutex.Lock()
+	defer coverFoldersMutex.Unlock()
+	coverFolders[directory] = folder
+	return folder.names
+}
+
+// FindArtistImage returns the artist image of the artist folder, or its cover image
+func FindArtistImage(directory string) string {
+	if artistImage := FindCoverFile(directory, Config.ArtistImageFiles); artistImage != "" {
+		return artistImage
+	}
+	return FindCoverFile(directory, Config.CoverFiles)
+}
+
+// HasEmbeddedCover checks the scanned tags of the media file for an embedded picture
+func HasEmbeddedCover(filename string) bool {
+	tags := Library.FileTags(filename, GetFileInfo(filename))
+	return tags != nil && tags.Cover
+}
+
+// CachedCover returns the file of the cover resized to the width from the cover cache, resizing it on a miss;
+// the cache key is the source path, its mtime and the width (with the covers of the songs of a playlist),
+// so a changed source is resized again;
+// the width and the height are limited to maxCoverSize
+func CachedCover(filename string, width int) string {
+	width = Min(width, maxCoverSize)
+	key := fmt.Sprintf("%s\x00%d\x00%d", filename, GetFileInfo(filename).ModTime().UnixNano(), width)
+	if Contains(filepath.Ext(filename), playlistFileExtensions...) {
+		playlist := ReadPlaylist(filename)
+		for _, source := range append([]string{playlistImage(playlist)}, playlistAlbumCovers(playlist)...) {
+			if fileInfo, err := os.Stat(source); err == nil {
+				key += fmt.Sprintf("\x00%s\x00%d", source, fileInfo.ModTime().UnixNano())
 			}
 		}
 	}
+	cacheFile := filepath.Join(Config.StateFolder, coverCacheFolder, fmt.Sprintf("%x", sha1.Sum([]byte(key))))
+	for _, extension := range []string{".jpg", ".png", ".webp"} {
+		if IsExists(cacheFile + extension) {
+			return cacheFile + extension
+		}
+	}
+	data, contentType := ReadCover(filename)
+	extension, ok := coverFileExtensions[contentType]
+	if !ok {
+		ProcessError(NewError("unsupported cover art format: %s", contentType))
+	} else if extension != ".webp" {
+		img := DecodeImage(data)
+		if bounds := img.Bounds(); bounds.Dy() > bounds.Dx() {
+			width = Max(Min(width, maxCoverSize*bounds.Dx()/bounds.Dy()), 1)
+		}
+		data = EncodeCover(ResizeImage(img, width), contentType)
+	}
+	ProcessError(os.MkdirAll(filepath.Dir(cacheFile), 0755))
+	WriteFileAtomic(cacheFile+extension, data)
+	return cacheFile + extension
+}
+
+// ResizeImage scales the image to the width keeping its aspect ratio; every axis is downscaled by area averaging
+// and upscaled by Catmull-Rom interpolation, in premultiplied alpha; the source is read row by row and only
+// the target is held in floats
+func ResizeImage(source image.Image, width int) image.Image {
+	bounds := source.Bounds()
+	sourceWidth, sourceHeight := bounds.Dx(), bounds.Dy()
+	height := Max(int(math.Round(float64(sourceHeight)*float64(width)/float64(sourceWidth))), 1)
+	if width <= 0 || width == sourceWidth && height == sourceHeight {
+		return toNRGBA(source)
+	}
+	columnWeights := resampleWeightsOf(sourceWidth, width)
+	// the target rows with their weights by source row, so every source row is added to its target rows at once
+	rowTargets := make([]resampleWeights, sourceHeight)
+	for t, rowWeights := range resampleWeightsOf(sourceHeight, height) {
+		for i, index := range rowWeights.indices {
+			rowTargets[index].indices = append(rowTargets[index].indices, t)
+			rowTargets[index].weights = append(rowTargets[index].weights, rowWeights.weights[i])
+		}
+	}
+	row := image.NewNRGBA(image.Rect(0, 0, sourceWidth, 1))
+	sourceRow, resampledRow := make([]float32, sourceWidth*4), make([]float32, width*4)
+	pixels := make([]float32, width*height*4)
+	for y, targets := range rowTargets {
+		if len(targets.indices) == 0 {
+			continue
+		}
+		readRow(row, source, bounds.Min.Y+y)
+		for p := 0; p < len(sourceRow); p += 4 {
+			alpha := float32(row.Pix[p+3])
+			sourceRow[p] = float32(row.Pix[p]) * alpha / 255
+			sourceRow[p+1] = float32(row.Pix[p+1]) * alpha / 255
+			sourceRow[p+2] = float32(row.Pix[p+2]) * alpha / 255
+			sourceRow[p+3] = alpha
+		}
+		for x, pixelWeights := range columnWeights {
+			t := x * 4
+			resampledRow[t], resampledRow[t+1], resampledRow[t+2], resampledRow[t+3] = 0, 0, 0, 0
+			for i, index := range pixelWeights.indices {
+				weight := pixelWeights.weights[i]
+				resampledRow[t] += sourceRow[index*4] * weight
+				resampledRow[t+1] += sourceRow[index*4+1] * weight
+				resampledRow[t+2] += sourceRow[index*4+2] * weight
+				resampledRow[t+3] += sourceRow[index*4+3] * weight
+			}
+		}
+		for i, index := range targets.indices {
+			weight, targetRow := targets.weights[i], pixels[index*width*4:(index+1)*width*4]
+			for p, value := range resampledRow {
+				targetRow[p] += value * weight
+			}
+		}
+	}
+	target := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for p := 0; p < len(pixels); p += 4 {
+		if alpha := clampChannel(pixels[p+3]); alpha > 0 {
+			target.Pix[p] = clampChannel(pixels[p] * 255 / float32(alpha))
+			target.Pix[p+1] = clampChannel(pixels[p+1] * 255 / float32(alpha))
+			target.Pix[p+2] = clampChannel(pixels[p+2] * 255 / float32(alpha))
+			target.Pix[p+3] = alpha
+		}
+	}
 	return target
 }
 
-func nearestNeighborInterpolation(img image.Image, x, y float64) color.Color {
-	return img.At(int(math.Floor(x)), int(math.Floor(y)))
+// toNRGBA returns the pixels of the image in a zero based NRGBA buffer
+func toNRGBA(img image.Image) *image.NRGBA {
+	bounds := img.Bounds()
+	if nrgba, ok := img.(*image.NRGBA); ok && bounds.Min == (image.Point{}) {
+		return nrgba
+	}
+	nrgba := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	for y := 0; y < bounds.Dy(); y++ {
+		readRow(nrgba.SubImage(image.Rect(0, y, bounds.Dx(), y+1)).(*image.NRGBA), img, bounds.Min.Y+y)
+	}
+	return nrgba
+}
+
+// readRow copies the row y of the image into the NRGBA row, converting the YCbCr buffer of the decoded JPEG files
+// directly
+func readRow(row *image.NRGBA, img image.Image, y int) {
+	bounds := img.Bounds()
+	if ycbcr, ok := img.(*image.YCbCr); ok {
+		for x := 0; x < bounds.Dx(); x++ {
+			yi, ci := ycbcr.YOffset(bounds.Min.X+x, y), ycbcr.COffset(bounds.Min.X+x, y)
+			row.Pix[x*4], row.Pix[x*4+1], row.Pix[x*4+2] = color.YCbCrToRGB(ycbcr.Y[yi], ycbcr.Cb[ci], ycbcr.Cr[ci])
+			row.Pix[x*4+3] = 255
+		}
+		return
+	}
+	draw.Draw(row, row.Bounds(), img, image.Pt(bounds.Min.X, y), draw.Src)
+}
+
+// resampleWeights are the source pixels contributing to a target pixel with their normalised weights
+type resampleWeights struct {
+	indices []int
+	weights []float32
 }
 
-func bilinearInterpolation(img image.Image, x, y float64) color.Color {
-	gx, tx := math.Modf(x)
-	gy, ty := math.Modf(y)
-	srcX, srcY := int(gx), int(gy)
-	r00, g00, b00, a00 := img.At(srcX+0, srcY+0).RGBA()
-	r10, g10, b10, a10 := img.At(srcX+1, srcY+0).RGBA()
-	r01, g01, b01, a01 := img.At(srcX+0, srcY+1).RGBA()
-	r11, g11, b11, a11 := img.At(srcX+1, srcY+1).RGBA()
-	return color.RGBA64{
-		R: blerp(r00, r10, r01, r11, tx, ty),
-		G: blerp(g00, g10, g01, g11, tx, ty),
-		B: blerp(b00, b10, b01, b11, tx, ty),
-		A: blerp(a00, a10, a01, a11, tx, ty),
+func resampleWeightsOf(sourceSize, targetSize int) []resampleWeights {
+	scale := float64(targetSize) / float64(sourceSize)
+	result := make([]resampleWeights, targetSize)
+	for t := range result {
+		var sum float64
+		var weights []float64
+		if scale <= 1 {
+			from, to := float64(t)/scale, math.Min(float64(t+1)/scale, float64(sourceSize))
+			for s := int(from); s < int(math.Ceil(to)); s++ {
+				result[t].indices = append(result[t].indices, s)
+				weights = append(weights, math.Min(to, float64(s+1))-math.Max(from, float64(s)))
+			}
+		} else {
+			center := (float64(t)+0.5)/scale - 0.5
+			for s := int(math.Floor(center)) - 1; s <= int(math.Floor(center))+2; s++ {
+				result[t].indices = append(result[t].indices, Min(Max(s, 0), sourceSize-1))
+				weights = append(weights, catmullRom(float64(s)-center))
+			}
+		}
+		for _, weight := range weights {
+			sum += weight
+		}
+		for _, weight := range weights {
+			result[t].weights = append(result[t].weights, float32(weight/sum))
+		}
 	}
+	return result
 }
 
-func blerp(c00, c10, c01, c11 uint32, tx, ty float64) uint16 {
-	return uint16(lerp(lerp(float64(c00), float64(c10), tx), lerp(float64(c01), float64(c11), tx), ty))
+// catmullRom is the cubic convolution kernel with a = -0.5
+func catmullRom(x float64) float64 {
+	switch x = math.Abs(x); {
+	case x < 1:
+		return 1.5*x*x*x - 2.5*x*x + 1
+	case x < 2:
+		return -0.5*x*x*x + 2.5*x*x - 4*x + 2
+	}
+	return 0
 }
 
-func lerp(s, e, t float64) float64 {
-	return s + (e-s)*t
+func clampChannel(value float32) uint8 {
+	return uint8(math.Max(0, math.Min(255, math.Round(float64(value)))))
 }
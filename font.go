@@ -0,0 +1,146 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"strings"
+)
+
+const (
+	fontWidth  = 5
+	fontHeight = 7
+	// fontMinScale is the smallest scale the text is drawn with, shortened if it does not fit
+	fontMinScale = 2
+)
+
+// bitmapFont is a 5x7 pixel font of the printable ASCII characters from the space to the tilde, one byte per row
+// with the leftmost pixel in bit 4
+var bitmapFont = [95][fontHeight]byte{
+	{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, {0x04, 0x04, 0x04, 0x04, 0x04, 0x00, 0x04},
+	{0x0a, 0x0a, 0x0a, 0x00, 0x00, 0x00, 0x00}, {0x0a, 0x0a, 0x1f, 0x0a, 0x1f, 0x0a, 0x0a},
+	{0x04, 0x0f, 0x14, 0x0e, 0x05, 0x1e, 0x04}, {0x18, 0x19, 0x02, 0x04, 0x08, 0x13, 0x03},
+	{0x0c, 0x12, 0x14, 0x08, 0x15, 0x12, 0x0d}, {0x04, 0x04, 0x04, 0x00, 0x00, 0x00, 0x00},
+	{0x02, 0x04, 0x08, 0x08, 0x08, 0x04, 0x02}, {0x08, 0x04, 0x02, 0x02, 0x02, 0x04, 0x08},
+	{0x00, 0x04, 0x15, 0x0e, 0x15, 0x04, 0x00}, {0x00, 0x04, 0x04, 0x1f, 0x04, 0x04, 0x00},
+	{0x00, 0x00, 0x00, 0x00, 0x0c, 0x04, 0x08}, {0x00, 0x00, 0x00, 0x1f, 0x00, 0x00, 0x00},
+	{0x00, 0x00, 0x00, 0x00, 0x00, 0x0c, 0x0c}, {0x00, 0x01, 0x02, 0x04, 0x08, 0x10, 0x00},
+	{0x0e, 0x11, 0x13, 0x15, 0x19, 0x11, 0x0e}, {0x04, 0x0c, 0x04, 0x04, 0x04, 0x04, 0x0e},
+	{0x0e, 0x11, 0x01, 0x02, 0x04, 0x08, 0x1f}, {0x1f, 0x02, 0x04, 0x02, 0x01, 0x11, 0x0e},
+	{0x02, 0x06, 0x0a, 0x12, 0x1f, 0x02, 0x02}, {0x1f, 0x10, 0x1e, 0x01, 0x01, 0x11, 0x0e},
+	{0x06, 0x08, 0x10, 0x1e, 0x11, 0x11, 0x0e}, {0x1f, 0x01, 0x02, 0x04, 0x08, 0x08, 0x08},
+	{0x0e, 0x11, 0x11, 0x0e, 0x11, 0x11, 0x0e}, {0x0e, 0x11, 0x11, 0x0f, 0x01, 0x02, 0x0c},
+	{0x00, 0x0c, 0x0c, 0x00, 0x0c, 0x0c, 0x00}, {0x00, 0x0c, 0x0c, 0x00, 0x0c, 0x04, 0x08},
+	{0x02, 0x04, 0x08, 0x10, 0x08, 0x04, 0x02}, {0x00, 0x00, 0x1f, 0x00, 0x1f, 0x00, 0x00},
+	{0x08, 0x04, 0x02, 0x01, 0x02, 0x04, 0x08}, {0x0e, 0x11, 0x01, 0x02, 0x04, 0x00, 0x04},
+	{0x0e, 0x11, 0x01, 0x0d, 0x15, 0x15, 0x0e}, {0x0e, 0x11, 0x11, 0x1f, 0x11, 0x11, 0x11},
+	{0x1e, 0x11, 0x11, 0x1e, 0x11, 0x11, 0x1e}, {0x0e, 0x11, 0x10, 0x10, 0x10, 0x11, 0x0e},
+	{0x1c, 0x12, 0x11, 0x11, 0x11, 0x12, 0x1c}, {0x1f, 0x10, 0x10, 0x1e, 0x10, 0x10, 0x1f},
+	{0x1f, 0x10, 0x10, 0x1e, 0x10, 0x10, 0x10}, {0x0e, 0x11, 0x10, 0x17, 0x11, 0x11, 0x0f},
+	{0x11, 0x11, 0x11, 0x1f, 0x11, 0x11, 0x11}, {0x0e, 0x04, 0x04, 0x04, 0x04, 0x04, 0x0e},
+	{0x07, 0x02, 0x02, 0x02, 0x02, 0x12, 0x0c}, {0x11, 0x12, 0x14, 0x18, 0x14, 0x12, 0x11},
+	{0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x1f}, {0x11, 0x1b, 0x15, 0x15, 0x11, 0x11, 0x11},
+	{0x11, 0x11, 0x19, 0x15, 0x13, 0x11, 0x11}, {0x0e, 0x11, 0x11, 0x11, 0x11, 0x11, 0x0e},
+	{0x1e, 0x11, 0x11, 0x1e, 0x10, 0x10, 0x10}, {0x0e, 0x11, 0x11, 0x11, 0x15, 0x12, 0x0d},
+	{0x1e, 0x11, 0x11, 0x1e, 0x14, 0x12, 0x11}, {0x0f, 0x10, 0x10, 0x0e, 0x01, 0x01, 0x1e},
+	{0x1f, 0x04, 0x04, 0x04, 0x04, 0x04, 0x04}, {0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x0e},
+	{0x11, 0x11, 0x11, 0x11, 0x11, 0x0a, 0x04}, {0x11, 0x11, 0x11, 0x15, 0x15, 0x15, 0x0a},
+	{0x11, 0x11, 0x0a, 0x04, 0x0a, 0x11, 0x11}, {0x11, 0x11, 0x11, 0x0a, 0x04, 0x04, 0x04},
+	{0x1f, 0x01, 0x02, 0x04, 0x08, 0x10, 0x1f}, {0x0e, 0x08, 0x08, 0x08, 0x08, 0x08, 0x0e},
+	{0x00, 0x10, 0x08, 0x04, 0x02, 0x01, 0x00}, {0x0e, 0x02, 0x02, 0x02, 0x02, 0x02, 0x0e},
+	{0x04, 0x0a, 0x11, 0x00, 0x00, 0x00, 0x00}, {0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x1f},
+	{0x08, 0x04, 0x02, 0x00, 0x00, 0x00, 0x00}, {0x00, 0x00, 0x0e, 0x01, 0x0f, 0x11, 0x0f},
+	{0x10, 0x10, 0x16, 0x19, 0x11, 0x11, 0x1e}, {0x00, 0x00, 0x0e, 0x10, 0x10, 0x11, 0x0e},
+	{0x01, 0x01, 0x0d, 0x13, 0x11, 0x11, 0x0f}, {0x00, 0x00, 0x0e, 0x11, 0x1f, 0x10, 0x0e},
+	{0x06, 0x09, 0x08, 0x1c, 0x08, 0x08, 0x08}, {0x00, 0x0f, 0x11, 0x11, 0x0f, 0x01, 0x0e},
+	{0x10, 0x10, 0x16, 0x19, 0x11, 0x11, 0x11}, {0x04, 0x00, 0x0c, 0x04, 0x04, 0x04, 0x0e},
+	{0x02, 0x00, 0x06, 0x02, 0x02, 0x12, 0x0c}, {0x10, 0x10, 0x12, 0x14, 0x18, 0x14, 0x12},
+	{0x0c, 0x04, 0x04, 0x04, 0x04, 0x04, 0x0e}, {0x00, 0x00, 0x1a, 0x15, 0x15, 0x11, 0x11},
+	{0x00, 0x00, 0x16, 0x19, 0x11, 0x11, 0x11}, {0x00, 0x00, 0x0e, 0x11, 0x11, 0x11, 0x0e},
+	{0x00, 0x00, 0x1e, 0x11, 0x1e, 0x10, 0x10}, {0x00, 0x00, 0x0d, 0x13, 0x0f, 0x01, 0x01},
+	{0x00, 0x00, 0x16, 0x19, 0x10, 0x10, 0x10}, {0x00, 0x00, 0x0e, 0x10, 0x0e, 0x01, 0x1e},
+	{0x08, 0x08, 0x1c, 0x08, 0x08, 0x09, 0x06}, {0x00, 0x00, 0x11, 0x11, 0x11, 0x13, 0x0d},
+	{0x00, 0x00, 0x11, 0x11, 0x11, 0x0a, 0x04}, {0x00, 0x00, 0x11, 0x11, 0x15, 0x15, 0x0a},
+	{0x00, 0x00, 0x11, 0x0a, 0x04, 0x0a, 0x11}, {0x00, 0x00, 0x11, 0x11, 0x0f, 0x01, 0x0e},
+	{0x00, 0x00, 0x1f, 0x02, 0x04, 0x08, 0x1f}, {0x02, 0x04, 0x04, 0x08, 0x04, 0x04, 0x02},
+	{0x04, 0x04, 0x04, 0x04, 0x04, 0x04, 0x04}, {0x08, 0x04, 0x04, 0x02, 0x04, 0x04, 0x08},
+	{0x00, 0x00, 0x08, 0x15, 0x02, 0x00, 0x00},
+}
+
+// fontFallbacks maps the accented Latin letters and the typographic punctuation to the characters of the font
+var fontFallbacks = func() map[rune]rune {
+	fallbacks := make(map[rune]rune)
+	from := []rune("ÀÁÂÃÄÅÇÈÉÊËÌÍÎÏÑÒÓÔÕÖØÙÚÛÜÝàáâãäåçèéêëìíîïñòóôõöøùúûüýÿ‐–—‘’“”")
+	to := []rune("AAAAAACEEEEIIIINOOOOOOUUUUYaaaaaaceeeeiiiinoooooouuuuyy---''\"\"")
+	for i := range from {
+		fallbacks[from[i]] = to[i]
+	}
+	return fallbacks
+}()
+
+// DrawText draws the text centered into the rectangle with the largest scale of the font which fits, wrapping
+// the words into lines; the text is shortened with ... if it does not fit even with the smallest scale
+func DrawText(img draw.Image, rect image.Rectangle, text string, textColor color.Color) {
+	text = strings.Join(strings.Fields(text), " ")
+	if text == "" {
+		return
+	}
+	var lines []string
+	scale := rect.Dx() / (fontWidth + 1)
+	for ; scale > fontMinScale; scale-- {
+		lines = wrapText(text, (rect.Dx()+scale)/((fontWidth+1)*scale))
+		if len(lines)*(fontHeight+2)*scale-2*scale <= rect.Dy() {
+			break
+		}
+	}
+	maxChars, maxLines := (rect.Dx()+scale)/((fontWidth+1)*scale), (rect.Dy()+2*scale)/((fontHeight+2)*scale)
+	if lines = wrapText(text, maxChars); len(lines) > maxLines {
+		lines = lines[:maxLines]
+		lastLine := []rune(lines[maxLines-1])
+		lines[maxLines-1] = string(lastLine[:Min(len(lastLine), maxChars-3)]) + "..."
+	}
+	top := rect.Min.Y + (rect.Dy()-(len(lines)*(fontHeight+2)*scale-2*scale))/2
+	for i, line := range lines {
+		left := rect.Min.X + (rect.Dx()-(len([]rune(line))*(fontWidth+1)*scale-scale))/2
+		for j, char := range []rune(line) {
+			origin := image.Pt(left+j*(fontWidth+1)*scale, top+i*(fontHeight+2)*scale)
+			drawGlyph(img, origin, char, scale, textColor)
+		}
+	}
+}
+
+// wrapText breaks the text into lines of at most maxChars characters at the spaces, or inside the too long words
+func wrapText(text string, maxChars int) []string {
+	var lines []string
+	var line []rune
+	for _, word := range strings.Split(text, " ") {
+		for chars := []rune(word); len(chars) > 0; {
+			if len(line) > 0 && len(line)+1+len(chars) <= maxChars {
+				line = append(append(line, ' '), chars...)
+				chars = nil
+			} else if len(line) > 0 {
+				lines, line = append(lines, string(line)), nil
+			} else {
+				n := Min(len(chars), Max(maxChars, 1))
+				line, chars = append(line, chars[:n]...), chars[n:]
+			}
+		}
+	}
+	return append(lines, string(line))
+}
+
+func drawGlyph(img draw.Image, origin image.Point, char rune, scale int, textColor color.Color) {
+	if fallback, ok := fontFallbacks[char]; ok {
+		char = fallback
+	} else if char < ' ' || char > '~' {
+		char = '?'
+	}
+	for y, row := range bitmapFont[char-' '] {
+		for x := 0; x < fontWidth; x++ {
+			if row&(1<<uint(fontWidth-1-x)) != 0 {
+				pixel := image.Rect(x*scale, y*scale, (x+1)*scale, (y+1)*scale).Add(origin)
+				draw.Draw(img, pixel, &image.Uniform{C: textColor}, image.Point{}, draw.Src)
+			}
+		}
+	}
+}
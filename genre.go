@@ -0,0 +1,164 @@
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// GenreIndex maps the genres to the songs and to the album folders containing them
+type GenreIndex struct {
+	Songs  map[string][]*Child
+	Albums map[string]map[string]bool
+}
+
+// LibraryGenres is the genre index of the library; it is built from the library index by the first request
+// and updated with the changes of the library
+var LibraryGenres = &GenreCache{}
+
+type GenreCache struct {
+	mutex sync.Mutex
+	// songs are the songs with a genre by album folder, nil until the first request
+	songs map[string][]*Child
+}
+
+// Index returns the genre index of the selected music folders
+func (cache *GenreCache) Index(musicFolderId string) *GenreIndex {
+	var roots []string
+	for i, musicFolder := range Config.MusicFolders {
+		if Contains(musicFolderId, "", strconv.Itoa(i)) {
+			roots = append(roots, filepath.Clean(musicFolder.Path)+PathSeparator+".")
+		}
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if cache.songs == nil {
+		cache.songs = readGenreSongs("")
+	}
+	index := &GenreIndex{Songs: make(map[string][]*Child), Albums: make(map[string]map[string]bool)}
+	for folder, songs := range cache.songs {
+		if isInFolders(folder, roots...) {
+			for _, song := range songs {
+				index.add(song)
+			}
+		}
+	}
+	for _, songs := range index.Songs {
+		sort.Slice(songs, func(i, j int) bool { return DecodeId(songs[i].Id) < DecodeId(songs[j].Id) })
+	}
+	return index
+}
+
+// Update reads the genres of the changed file or folder and of its album folder again
+func (cache *GenreCache) Update(path string) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if cache.songs == nil {
+		return
+	}
+	albumFolder := AlbumFolder(path)
+	for folder := range cache.songs {
+		if isInFolders(folder, path, albumFolder) {
+			delete(cache.songs, folder)
+		}
+	}
+	for folder, songs := range readGenreSongs(path, albumFolder) {
+		cache.songs[folder] = songs
+	}
+}
+
+// Reset drops the index after a scan of the library, so the next request builds it again
+func (cache *GenreCache) Reset() {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.songs = nil
+}
+
+// readGenreSongs collects the songs with a genre in the folders from the library index by album folder;
+// the songs of an album with an album.m3u8 file are read from it, so its genre directives are merged
+func readGenreSongs(folders ...string) map[string][]*Child {
+	songs := make(map[string][]*Child)
+	var playlists []string
+	var mutex sync.Mutex
+	Library.Walk("", func(entry *PathInfo) {
+		if path := entry.Path(); !isInFolders(path, folders...) {
+			return
+		} else if !entry.IsDir() && Contains(filepath.Ext(path), mediaFileExtensions...) {
+			song := BuildChild(entry)
+			mutex.Lock()
+			defer mutex.Unlock()
+			songs[AlbumFolder(path)] = append(songs[AlbumFolder(path)], song)
+		} else if entry.Name() == "album.m3u8" && !IsDiscFolder(entry.Parent) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			playlists = append(playlists, path)
+		}
+	})
+	for _, playlistFile := range playlists {
+		songs[DirName(playlistFile)] = ReadPlaylist(playlistFile).GetPlaylistWithSongs().Entry
+	}
+	for folder := range songs {
+		n := 0
+		for _, song := range songs[folder] {
+			if song.Genre != "" {
+				songs[folder][n] = song
+				n++
+			}
+		}
+		songs[folder] = songs[folder][:n]
+	}
+	return songs
+}
+
+// isInFolders checks that the path is one of the folders or is inside one; an empty folder contains all paths
+func isInFolders(path string, folders ...string) bool {
+	for _, folder := range folders {
+		if folder == "" || path == folder || strings.HasPrefix(path, folder+PathSeparator) {
+			return true
+		}
+	}
+	return false
+}
+
+func (index *GenreIndex) add(song *Child) {
+	path := DecodeId(song.Id)
+	if song.IsDir || strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+		return
+	}
+	for _, genre := range SplitGenres(song.Genre) {
+		// the songs are copied, as the responses fill the user dependent fields
+		songCopy := *song
+		index.Songs[genre] = append(index.Songs[genre], &songCopy)
+		if index.Albums[genre] == nil {
+			index.Albums[genre] = make(map[string]bool)
+		}
+		index.Albums[genre][AlbumFolder(path)] = true
+	}
+}
+
+// Genres returns the genres of the index with their song and album counts, ordered by name
+func (index *GenreIndex) Genres() *Genres {
+	genres := &Genres{}
+	for genre, songs := range index.Songs {
+		genres.Genre = append(genres.Genre, &Genre{
+			Value: genre, SongCount: len(songs), AlbumCount: len(index.Albums[genre]),
+		})
+	}
+	sort.Slice(genres.Genre, func(i, j int) bool {
+		return strings.ToLower(genres.Genre[i].Value) < strings.ToLower(genres.Genre[j].Value)
+	})
+	return genres
+}
+
+// SplitGenres splits a multi-value genre string like "Rock; Blues"
+func SplitGenres(genre string) []string {
+	var genres []string
+	for _, value := range strings.Split(genre, ";") {
+		if value = strings.TrimSpace(value); value != "" && !Contains(value, genres...) {
+			genres = append(genres, value)
+		}
+	}
+	return genres
+}
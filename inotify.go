@@ -0,0 +1,191 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+type inotifyEvent struct {
+	Wd     int32
+	Mask   uint32
+	Cookie uint32
+	Len    uint32
+}
+
+var (
+	inCloseWrite     = uint32(0x8)
+	inMovedFrom      = uint32(0x40)
+	inMovedTo        = uint32(0x80)
+	inCreate         = uint32(0x100)
+	inDelete         = uint32(0x200)
+	inQueueOverflow  = uint32(0x4000)
+	inIgnored        = uint32(0x8000)
+	inOnlyDir        = uint32(0x1000000)
+	inIsDir          = uint32(0x40000000)
+	inCloexec        = 0x80000
+	inotifyWatchMask = inCloseWrite | inMovedFrom | inMovedTo | inCreate | inDelete | inOnlyDir
+	// inotify_init1, inotify_add_watch, inotify_rm_watch
+	sysInotifyArch = map[string][3]int{
+		"386": {332, 292, 293}, "amd64": {294, 254, 255}, "arm": {360, 317, 318}, "arm64": {26, 27, 28},
+		"ppc": {318, 276, 277}, "ppc64": {318, 276, 277}, "ppc64le": {318, 276, 277}, "loong64": {26, 27, 28},
+		"s390x": {324, 285, 286}, "sparc64": {322, 152, 156}, "riscv64": {26, 27, 28},
+		"mips": {4329, 4285, 4286}, "mipsle": {4329, 4285, 4286}, "mips64": {5288, 5244, 5245},
+		"mips64le": {5288, 5244, 5245},
+	}
+	// the library is rescanned periodically if the changes can not be watched
+	libraryRescanInterval = 15 * time.Minute
+)
+
+// LibraryWatcher keeps the library index and the child cache up to date with the changes
+// of the music folders and the playlist folder
+type LibraryWatcher struct {
+	fd       int
+	syscalls [3]int
+	mutex    sync.Mutex
+	watches  map[int32]string
+	limited  bool
+}
+
+// WatchLibrary starts watching the folders; it falls back to periodic rescans if inotify is not available
+func WatchLibrary() {
+	watcher, err := newLibraryWatcher()
+	if err != nil {
+		log.Printf("Watching the library is not possible, rescanning every %v: %v\n", libraryRescanInterval, err)
+		go rescanLibrary()
+		return
+	}
+	go watcher.run()
+	for _, musicFolder := range Config.MusicFolders {
+		watcher.addWatches(filepath.Clean(musicFolder.Path) + PathSeparator + ".")
+	}
+	if Config.PlaylistFolder != "" && IsExists(Config.PlaylistFolder) {
+		watcher.addWatches(filepath.Clean(Config.PlaylistFolder))
+	}
+}
+
+func rescanLibrary() {
+	for range time.Tick(libraryRescanInterval) {
+		Library.StartScan()
+	}
+}
+
+func newLibraryWatcher() (*LibraryWatcher, error) {
+	sysInotify, ok := sysInotifyArch[runtime.GOARCH]
+	if !ok || runtime.GOOS != "linux" {
+		return nil, NewError("inotify is not supported on %s/%s", runtime.GOOS, runtime.GOARCH)
+	}
+	fd, _, errno := syscall.RawSyscall(uintptr(sysInotify[0]), uintptr(inCloexec), 0, 0)
+	if errno != 0 {
+		return nil, errno
+	}
+	return &LibraryWatcher{fd: int(fd), syscalls: sysInotify, watches: make(map[int32]string)}, nil
+}
+
+// addWatches watches the folder and its subfolders; the watches are added before the folders are read,
+// so the files created meanwhile are not missed
+func (watcher *LibraryWatcher) addWatches(root string) {
+	Walk(root, func(entry *PathInfo) {
+		if entry.IsDir() {
+			watcher.addWatch(entry.Path())
+		}
+	})
+}
+
+func (watcher *LibraryWatcher) addWatch(path string) {
+	pathPtr := &append([]byte(path), 0x0)[0]
+	wd, _, errno := syscall.Syscall(uintptr(watcher.syscalls[1]), uintptr(watcher.fd),
+		uintptr(unsafe.Pointer(pathPtr)), uintptr(inotifyWatchMask))
+	watcher.mutex.Lock()
+	defer watcher.mutex.Unlock()
+	if errno == syscall.ENOSPC {
+		if !watcher.limited {
+			watcher.limited = true
+			log.Printf("Watch limit reached (fs.inotify.max_user_watches), rescanning every %v\n",
+				libraryRescanInterval)
+			go rescanLibrary()
+		}
+	} else if errno != 0 {
+		log.Printf("Watching %s failed: %v\n", path, errno)
+	} else {
+		watcher.watches[int32(wd)] = path
+	}
+}
+
+func (watcher *LibraryWatcher) removeWatches(path string) {
+	watcher.mutex.Lock()
+	defer watcher.mutex.Unlock()
+	for wd, watchedPath := range watcher.watches {
+		if watchedPath == path || strings.HasPrefix(watchedPath, path+PathSeparator) {
+			_, _, _ = syscall.Syscall(uintptr(watcher.syscalls[2]), uintptr(watcher.fd), uintptr(wd), 0)
+			delete(watcher.watches, wd)
+		}
+	}
+}
+
+func (watcher *LibraryWatcher) run() {
+	buffer := make([]byte, 64*1024)
+	for {
+		n, err := syscall.Read(watcher.fd, buffer)
+		if err == syscall.EINTR {
+			continue
+		} else if err != nil {
+			log.Printf("Watching the library stopped, rescanning every %v: %v\n", libraryRescanInterval, err)
+			rescanLibrary()
+			return
+		}
+		for offset := 0; offset+int(unsafe.Sizeof(inotifyEvent{})) <= n; {
+			event := (*inotifyEvent)(unsafe.Pointer(&buffer[offset]))
+			nameStart := offset + int(unsafe.Sizeof(inotifyEvent{}))
+			name := strings.TrimRight(string(buffer[nameStart:nameStart+int(event.Len)]), "\x00")
+			offset = nameStart + int(event.Len)
+			watcher.handle(event.Wd, event.Mask, name)
+		}
+	}
+}
+
+func (watcher *LibraryWatcher) handle(wd int32, mask uint32, name string) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("Handling the change of %s failed: %v\n", name, p)
+		}
+	}()
+	if mask&inQueueOverflow != 0 {
+		log.Printf("Too many changes to follow, rescanning the library\n")
+		Library.StartScan()
+		return
+	}
+	watcher.mutex.Lock()
+	directory, ok := watcher.watches[wd]
+	if mask&inIgnored != 0 {
+		delete(watcher.watches, wd)
+	}
+	watcher.mutex.Unlock()
+	if !ok || name == "" {
+		return
+	}
+	path := directory + PathSeparator + name
+	switch {
+	case mask&(inDelete|inMovedFrom) != 0:
+		if mask&inIsDir != 0 {
+			watcher.removeWatches(path)
+		}
+		Library.Remove(path)
+	case mask&(inCreate|inMovedTo) != 0 && mask&inIsDir != 0:
+		watcher.addWatches(path)
+		Library.Update(path)
+	case mask&(inCloseWrite|inMovedTo) != 0, mask&inCreate != 0 && isSymlink(path):
+		Library.Update(path)
+	}
+}
+
+func isSymlink(path string) bool {
+	fileInfo, err := os.Lstat(path)
+	return err == nil && fileInfo.Mode()&os.ModeSymlink != 0
+}
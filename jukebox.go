@@ -5,48 +5,163 @@ import (
 	"io"
 	"log"
 	"math"
+	"net"
 	"net/textproto"
+	"path/filepath"
 	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	mpdPoolSize          = 4
+	mpdTimeout           = 10 * time.Second
+	mpdKeepaliveInterval = 30 * time.Second
+	mpdReconnectMaxDelay = 30 * time.Second
+	// mpdIdleSubsystems are the changes refreshing the cached status and queue
+	mpdIdleSubsystems = "player mixer options playlist"
+)
+
+var (
+	// mpdClients are the shared MPD clients by partition
+	mpdClients      = make(map[string]*MPD)
+	mpdClientsMutex sync.Mutex
+	// mpdQueries are the commands which do not change the state of MPD
+	mpdQueries = []string{"status", "playlist", "currentsong", "lsinfo", "ping"}
 )
 
 type Jukebox interface {
-	Status() *JukeboxStatus
-	Playlist() *JukeboxPlaylist
-	Add(files ...string)
-	Set(files ...string)
-	Start()
-	Stop()
-	Skip(trackPos int, seconds int)
-	Clear()
-	Remove(trackPos int)
-	Shuffle()
-	SetGain(volume float32)
-	Disconnect()
+	Status() (*JukeboxStatus, error)
+	Playlist() (*JukeboxPlaylist, error)
+	Add(files ...string) error
+	Set(files ...string) error
+	Start() error
+	Stop() error
+	Skip(trackPos int, seconds int) error
+	Clear() error
+	Remove(trackPos int) error
+	Shuffle() error
+	SetGain(volume float32) error
 }
 
-func NewJukebox() Jukebox {
-	return NewMPD(Config.MPD.UnixSocket)
+// GetJukebox returns the shared MPD client of the partition of the user, which is started by the first call
+func GetJukebox(username string) Jukebox {
+	partition := Config.MPD.Partition
+	if userPartition := GetUserConfig(username).MPDPartition; userPartition != "" {
+		partition = userPartition
+	}
+	mpdClientsMutex.Lock()
+	defer mpdClientsMutex.Unlock()
+	if mpdClients[partition] == nil {
+		mpdClients[partition] = NewMPD(Config.MPD.Address, Config.MPD.Password, partition)
+	}
+	return mpdClients[partition]
 }
 
 // MPD protocol description: https://mpd.readthedocs.io/en/latest/protocol.html
+// MPD is a long-lived client sending the commands over a small pool of connections, which are reopened after
+// a restart of MPD; the status and the queue are cached by a subscriber of the idle events
 type MPD struct {
-	Connection *textproto.Conn
-	Version    string
+	address     string
+	password    string
+	partition   string
+	connections chan *MPDConnection
+	mutex       sync.RWMutex
+	status      MPDResponse
+	statusTime  time.Time
+	playlist    []string
+	cached      bool
+	// changes counts the commands sent, a refresh of the cache overlapping one of them is outdated
+	changes int64
+}
+
+// MPDConnection is a connection to MPD greeted with the protocol version
+type MPDConnection struct {
+	*textproto.Conn
+	conn    net.Conn
+	Version string
 }
 
 type MPDResponse map[string][]byte
 
-func NewMPD(unixSocket string) *MPD {
-	connection := ProcessErrorArg(textproto.Dial("unix", unixSocket)).(*textproto.Conn)
-	line := ProcessErrorArg(connection.ReadLine()).(string)
-	if line[:6] != "OK MPD" {
-		log.Panicln("MPD ERROR: No greetings from MPD!")
+// mpdError is an ACK response of MPD, the connection stays usable after it
+type mpdError string
+
+func (err mpdError) Error() string {
+	return string(err)
+}
+
+// mpdWriteError is a failure to send a command, so the command has not reached MPD and can be sent again
+type mpdWriteError struct {
+	error
+}
+
+func NewMPD(address, password, partition string) *MPD {
+	mpd := &MPD{
+		address: address, password: password, partition: partition,
+		connections: make(chan *MPDConnection, mpdPoolSize),
+	}
+	go mpd.subscribe()
+	go mpd.keepAlive()
+	return mpd
+}
+
+// DialMPD connects to the unix socket or the host:port address, then sends the password and selects
+// the partition if they are set
+func DialMPD(address, password, partition string) (*MPDConnection, error) {
+	dialer := &net.Dialer{Timeout: mpdTimeout, KeepAlive: mpdKeepaliveInterval}
+	conn, err := dialer.Dial(mpdNetwork(address), address)
+	if err != nil {
+		return nil, err
+	}
+	connection := &MPDConnection{Conn: textproto.NewConn(conn), conn: conn}
+	if err := conn.SetDeadline(time.Now().Add(mpdTimeout)); err != nil {
+		_ = connection.Close()
+		return nil, err
+	} else if line, err := connection.ReadLine(); err != nil {
+		_ = connection.Close()
+		return nil, err
+	} else if !strings.HasPrefix(line, "OK MPD ") {
+		_ = connection.Close()
+		return nil, NewError("no greetings from MPD: %s", line)
+	} else {
+		connection.Version = line[7:]
+	}
+	if password != "" {
+		if _, err := connection.Command("password "+quoteMPD(password), time.Now().Add(mpdTimeout)); err != nil {
+			_ = connection.Close()
+			return nil, NewError("MPD password is rejected: %v", err)
+		}
+	}
+	if partition != "" {
+		if _, err := connection.Command("partition "+quoteMPD(partition), time.Now().Add(mpdTimeout)); err != nil {
+			_ = connection.Close()
+			return nil, NewError("MPD partition %s can not be selected: %v", partition, err)
+		}
+	}
+	return connection, nil
+}
+
+// mpdNetwork returns tcp for the host:port addresses, otherwise unix for the socket paths (including the abstract
+// sockets starting with @)
+func mpdNetwork(address string) string {
+	if _, _, err := net.SplitHostPort(address); err == nil {
+		return "tcp"
 	}
-	return &MPD{Connection: connection, Version: line[7:]}
+	return "unix"
 }
 
-func (mpd *MPD) Status() *JukeboxStatus {
-	status := mpd.sendCommand("status")
+func (mpd *MPD) Status() (*JukeboxStatus, error) {
+	mpd.mutex.RLock()
+	status, statusTime, cached := mpd.status, mpd.statusTime, mpd.cached
+	mpd.mutex.RUnlock()
+	if !cached {
+		var err error
+		if status, err = mpd.sendCommand("status"); err != nil {
+			return nil, err
+		}
+		statusTime = time.Now()
+	}
 	jukeboxStatus := &JukeboxStatus{
 		CurrentIndex: int(ParseNumber(string(status["song"]))),
 		Playing:      string(status["state"]) == "play",
@@ -54,84 +169,173 @@ func (mpd *MPD) Status() *JukeboxStatus {
 		State:        string(status["state"]),
 	}
 	if elapsed, ok := status["elapsed"]; ok {
-		jukeboxStatus.Position = int(math.Round(ParseNumber(string(elapsed))))
+		position := ParseNumber(string(elapsed))
+		if jukeboxStatus.Playing {
+			position += time.Since(statusTime).Seconds()
+		}
+		jukeboxStatus.Position = int(math.Round(position))
 	}
-	return jukeboxStatus
+	return jukeboxStatus, nil
 }
 
-func (mpd *MPD) Playlist() *JukeboxPlaylist {
-	jukeboxPlaylist := &JukeboxPlaylist{}
-	jukeboxPlaylist.JukeboxStatus = *mpd.Status()
-	for _, file := range mpd.getPlaylist() {
-		child := BuildChild(NewPathInfo(DirName(file), GetFileInfo(file)))
+func (mpd *MPD) Playlist() (*JukeboxPlaylist, error) {
+	status, err := mpd.Status()
+	if err != nil {
+		return nil, err
+	}
+	jukeboxPlaylist := &JukeboxPlaylist{JukeboxStatus: *status}
+	mpd.mutex.RLock()
+	playlist, cached := mpd.playlist, mpd.cached
+	mpd.mutex.RUnlock()
+	if !cached {
+		if playlist, err = mpd.getPlaylist(); err != nil {
+			return nil, err
+		}
+	}
+	for _, uri := range playlist {
+		var child *Child
+		if file := mpd.file(uri); file != "" {
+			child = BuildChild(NewPathInfo(DirName(file), GetFileInfo(file)))
+		} else {
+			child = mpd.uriChild(uri)
+		}
 		jukeboxPlaylist.Entry = append(jukeboxPlaylist.Entry, child)
 	}
-	return jukeboxPlaylist
+	return jukeboxPlaylist, nil
 }
 
-func (mpd *MPD) Add(files ...string) {
+func (mpd *MPD) Add(files ...string) error {
 	for _, file := range files {
-		mpd.sendCommand(fmt.Sprintf("add %s", mpd.quote(file)))
+		if _, err := mpd.sendCommand(fmt.Sprintf("add %s", quoteMPD(mpd.uri(file)))); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
-func (mpd *MPD) Set(files ...string) {
-	playlist := mpd.getPlaylist()
+// Set replaces the changed songs of the queue in place, adds the new ones and removes the rest in one command
+// list, so the queue is never seen half updated
+func (mpd *MPD) Set(files ...string) error {
+	playlist, err := mpd.getPlaylist()
+	if err != nil {
+		return err
+	}
+	var commands []string
 	for trackPos, file := range files {
-		if len(playlist) > trackPos {
-			if playlist[trackPos] != file {
-				songId := mpd.sendCommand(fmt.Sprintf("addid %s", mpd.quote(file)))["Id"]
-				mpd.sendCommand(fmt.Sprintf("delete %d", trackPos))
-				mpd.sendCommand(fmt.Sprintf("moveid %s %d", songId, trackPos))
-			}
-		} else {
-			mpd.Add(file)
+		if uri := mpd.uri(file); len(playlist) <= trackPos {
+			commands = append(commands, fmt.Sprintf("add %s", quoteMPD(uri)))
+		} else if playlist[trackPos] != uri {
+			commands = append(commands, fmt.Sprintf("addid %s %d", quoteMPD(uri), trackPos),
+				fmt.Sprintf("delete %d", trackPos+1))
 		}
 	}
 	for trackPos := len(playlist) - 1; trackPos >= len(files); trackPos-- {
-		mpd.Remove(trackPos)
+		commands = append(commands, fmt.Sprintf("delete %d", trackPos))
 	}
+	if len(commands) == 0 {
+		return nil
+	}
+	commands = append(append([]string{"command_list_begin"}, commands...), "command_list_end")
+	_, err = mpd.sendCommand(strings.Join(commands, "\n"))
+	return err
+}
+
+func (mpd *MPD) Start() error {
+	_, err := mpd.sendCommand("play")
+	return err
 }
 
-func (mpd *MPD) Start() {
-	mpd.sendCommand("play")
+func (mpd *MPD) Stop() error {
+	_, err := mpd.sendCommand("pause 1")
+	return err
 }
 
-func (mpd *MPD) Stop() {
-	mpd.sendCommand("pause 1")
+func (mpd *MPD) Skip(trackPos, seconds int) error {
+	if _, err := mpd.sendCommand(fmt.Sprintf("seek %d %d", trackPos, seconds)); err != nil {
+		return err
+	}
+	return mpd.Start()
 }
 
-func (mpd *MPD) Skip(trackPos, seconds int) {
-	mpd.sendCommand(fmt.Sprintf("seek %d %d", trackPos, seconds))
-	mpd.Start()
+func (mpd *MPD) Clear() error {
+	_, err := mpd.sendCommand("clear")
+	return err
 }
 
-func (mpd *MPD) Clear() {
-	mpd.sendCommand("clear")
+func (mpd *MPD) Remove(trackPos int) error {
+	_, err := mpd.sendCommand(fmt.Sprintf("delete %d", trackPos))
+	return err
 }
 
-func (mpd *MPD) Remove(trackPos int) {
-	mpd.sendCommand(fmt.Sprintf("delete %d", trackPos))
+func (mpd *MPD) Shuffle() error {
+	_, err := mpd.sendCommand("shuffle")
+	return err
 }
 
-func (mpd *MPD) Shuffle() {
-	mpd.sendCommand("shuffle")
+func (mpd *MPD) SetGain(volume float32) error {
+	_, err := mpd.sendCommand(fmt.Sprintf("setvol %d", int(volume*100.0)))
+	return err
 }
 
-func (mpd *MPD) SetGain(volume float32) {
-	mpd.sendCommand(fmt.Sprintf("setvol %d", int(volume*100.0)))
+func (mpd *MPD) Info(file string) (MPDResponse, error) {
+	return mpd.sendCommand(fmt.Sprintf("lsinfo %s", quoteMPD(file)))
 }
 
-func (mpd *MPD) Info(file string) MPDResponse {
-	return mpd.sendCommand(fmt.Sprintf("lsinfo %s", mpd.quote(file)))
+func (mpd *MPD) getPlaylist() ([]string, error) {
+	playlistMap, err := mpd.sendCommand("playlist")
+	if err != nil {
+		return nil, err
+	}
+	return parsePlaylist(playlistMap), nil
 }
 
-func (mpd *MPD) Disconnect() {
-	Close(mpd.Connection)
+// uri returns the URI of the file for MPD; MPD accepts the absolute paths from the local clients only, so over TCP
+// the path relative to the music directory of MPD is sent
+func (mpd *MPD) uri(file string) string {
+	if mpdNetwork(mpd.address) == "tcp" && Config.MPD.MusicDirectory != "" {
+		if uri, err := filepath.Rel(filepath.Clean(Config.MPD.MusicDirectory), filepath.Clean(file)); err == nil &&
+			uri != ".." && !strings.HasPrefix(uri, ".."+PathSeparator) {
+			return filepath.ToSlash(uri)
+		}
+	}
+	return file
 }
 
-func (mpd *MPD) getPlaylist() []string {
-	playlistMap := mpd.sendCommand("playlist")
+// file returns the path in its music folder of the song URI of the queue, which is relative to the music directory
+// of MPD unless it was added as an absolute path, or "" if it is not a file of a music folder (e.g. a stream)
+func (mpd *MPD) file(uri string) string {
+	if strings.Contains(uri, "://") {
+		return ""
+	} else if !filepath.IsAbs(uri) {
+		if Config.MPD.MusicDirectory == "" {
+			return ""
+		}
+		uri = filepath.Join(Config.MPD.MusicDirectory, filepath.FromSlash(uri))
+	}
+	for _, musicFolder := range Config.MusicFolders {
+		root := filepath.Clean(musicFolder.Path)
+		if file := filepath.Clean(uri); strings.HasPrefix(file, root+PathSeparator) && IsExists(file) {
+			return root + MusicFolderSeparator + file[len(root)+1:]
+		}
+	}
+	return ""
+}
+
+// uriChild builds the song of a queue entry which is not a file of the music folders from its tags in MPD
+func (mpd *MPD) uriChild(uri string) *Child {
+	child := &Child{Id: EncodeId(uri), Title: uri}
+	if strings.Contains(uri, "://") {
+		return child
+	} else if info, err := mpd.Info(uri); err == nil && len(info["Title"]) > 0 {
+		child.Title, child.Artist, child.Album = string(info["Title"]), string(info["Artist"]), string(info["Album"])
+		child.Duration = int(math.Round(ParseNumber(string(info["duration"]))))
+	} else {
+		child.Title = filepath.Base(filepath.FromSlash(uri))
+	}
+	return child
+}
+
+func parsePlaylist(playlistMap MPDResponse) []string {
 	playlist := make([]string, len(playlistMap))
 	for key, entry := range playlistMap {
 		playlist[int(ParseNumber(key[:strings.Index(key, ":")]))] = string(entry)
@@ -139,30 +343,177 @@ func (mpd *MPD) getPlaylist() []string {
 	return playlist
 }
 
-func (mpd *MPD) sendCommand(command string) MPDResponse {
-	id := ProcessErrorArg(mpd.Connection.Cmd(command)).(uint)
-	mpd.Connection.StartResponse(id)
-	defer mpd.Connection.EndResponse(id)
+// sendCommand sends the command (or the lines of a command list) over a pooled connection; a broken pooled
+// connection (e.g. after a restart of MPD) is closed and the command is sent again over the next one only if
+// it has not reached MPD or it is a query, so a change is never run twice
+func (mpd *MPD) sendCommand(command string) (MPDResponse, error) {
+	query := Contains(strings.Fields(command)[0], mpdQueries...)
+	if !query {
+		defer mpd.invalidate()
+	}
+	for {
+		connection, pooled, err := mpd.connection()
+		if err != nil {
+			return nil, err
+		}
+		response, err := connection.Command(command, time.Now().Add(mpdTimeout))
+		if _, ok := err.(mpdError); ok || err == nil {
+			mpd.release(connection)
+			return response, err
+		}
+		_ = connection.Close()
+		if _, ok := err.(mpdWriteError); !pooled || !ok && !query {
+			return nil, err
+		}
+	}
+}
+
+// connection returns an idle pooled connection, or a new one if all are in use
+func (mpd *MPD) connection() (*MPDConnection, bool, error) {
+	select {
+	case connection := <-mpd.connections:
+		return connection, true, nil
+	default:
+		connection, err := DialMPD(mpd.address, mpd.password, mpd.partition)
+		return connection, false, err
+	}
+}
+
+// release returns the connection to the pool, or closes it if the pool is full
+func (mpd *MPD) release(connection *MPDConnection) {
+	select {
+	case mpd.connections <- connection:
+	default:
+		_ = connection.Close()
+	}
+}
+
+// keepAlive pings the pooled connections, so MPD does not close them after its connection_timeout
+func (mpd *MPD) keepAlive() {
+	for range time.Tick(mpdKeepaliveInterval) {
+		for i := len(mpd.connections); i > 0; i-- {
+			select {
+			case connection := <-mpd.connections:
+				if _, err := connection.Command("ping", time.Now().Add(mpdTimeout)); err != nil {
+					_ = connection.Close()
+				} else {
+					mpd.release(connection)
+				}
+			default:
+			}
+		}
+	}
+}
+
+// subscribe keeps the cache up to date with the idle events of a dedicated connection, reconnecting
+// with a growing delay while MPD is unreachable
+func (mpd *MPD) subscribe() {
+	delay := time.Second
+	for {
+		connection, err := DialMPD(mpd.address, mpd.password, mpd.partition)
+		if err == nil {
+			log.Printf("MPD connected: %s%s (protocol %s)\n", mpd.address, mpd.partitionName(), connection.Version)
+			err = mpd.watch(connection)
+			_ = connection.Close()
+			delay = time.Second
+		}
+		mpd.mutex.Lock()
+		mpd.status, mpd.playlist, mpd.cached = nil, nil, false
+		mpd.mutex.Unlock()
+		if delay == time.Second {
+			log.Printf("MPD is unreachable%s, reconnecting: %v\n", mpd.partitionName(), err)
+		}
+		time.Sleep(delay)
+		if delay *= 2; delay > mpdReconnectMaxDelay {
+			delay = mpdReconnectMaxDelay
+		}
+	}
+}
+
+func (mpd *MPD) partitionName() string {
+	if mpd.partition == "" {
+		return ""
+	}
+	return " (partition " + mpd.partition + ")"
+}
+
+// watch refreshes the cache after every change of the player, the mixer, the options or the queue
+func (mpd *MPD) watch(connection *MPDConnection) error {
+	for {
+		if err := mpd.refresh(connection); err != nil {
+			return err
+		} else if _, err := connection.Command("idle "+mpdIdleSubsystems, time.Time{}); err != nil {
+			return err
+		}
+	}
+}
+
+// refresh caches the status, and the queue if its version changed
+func (mpd *MPD) refresh(connection *MPDConnection) error {
+	mpd.mutex.RLock()
+	changes, playlist, playlistVersion := mpd.changes, mpd.playlist, string(mpd.status["playlist"])
+	mpd.mutex.RUnlock()
+	status, err := connection.Command("status", time.Now().Add(mpdTimeout))
+	if err != nil {
+		return err
+	} else if playlist == nil || string(status["playlist"]) != playlistVersion {
+		playlistMap, err := connection.Command("playlist", time.Now().Add(mpdTimeout))
+		if err != nil {
+			return err
+		}
+		playlist = parsePlaylist(playlistMap)
+	}
+	mpd.mutex.Lock()
+	defer mpd.mutex.Unlock()
+	mpd.status, mpd.statusTime, mpd.playlist = status, time.Now(), playlist
+	mpd.cached = mpd.changes == changes
+	return nil
+}
+
+// invalidate outdates the cache after a command, until the idle event of the change refreshes it
+func (mpd *MPD) invalidate() {
+	mpd.mutex.Lock()
+	defer mpd.mutex.Unlock()
+	mpd.changes++
+	mpd.cached = false
+}
+
+// Command sends the command (the lines of a command list together) and reads its response until the deadline
+// (none if zero)
+func (connection *MPDConnection) Command(command string, deadline time.Time) (MPDResponse, error) {
+	if err := connection.conn.SetDeadline(deadline); err != nil {
+		return nil, mpdWriteError{err}
+	}
+	id, err := connection.Cmd("%s", strings.Replace(command, "\n", "\r\n", -1))
+	if err != nil {
+		return nil, mpdWriteError{err}
+	}
+	connection.StartResponse(id)
+	defer connection.EndResponse(id)
 	response := make(MPDResponse)
 	for {
-		line := ProcessErrorArg(mpd.Connection.ReadLine()).(string)
-		if line == "OK" {
-			break
+		line, err := connection.ReadLine()
+		if err != nil {
+			return nil, err
+		} else if line == "OK" {
+			return response, nil
 		} else if strings.HasPrefix(line, "ACK ") {
-			log.Panicf("MPD ERROR: %s\n", line[4:])
+			return nil, mpdError(line[4:])
 		} else if strings.HasPrefix(line, "binary: ") {
 			data := make([]byte, int(ParseNumber(line[8:])))
-			ProcessErrorArg(io.ReadFull(mpd.Connection.R, data))
-			ProcessErrorArg(mpd.Connection.R.ReadByte())
+			if _, err := io.ReadFull(connection.R, data); err != nil {
+				return nil, err
+			} else if _, err := connection.R.ReadByte(); err != nil {
+				return nil, err
+			}
 			response["binary"] = data
 		} else if separatorIndex := strings.Index(line, ": "); separatorIndex > 1 {
 			response[line[:separatorIndex]] = []byte(line[separatorIndex+2:])
 		}
 	}
-	return response
 }
 
-func (mpd *MPD) quote(str string) string {
+func quoteMPD(str string) string {
 	replacer := strings.NewReplacer("\\", "\\\\", "'", "\\'", "\"", "\\\"")
 	return "\"" + replacer.Replace(str) + "\""
 }
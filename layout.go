@@ -0,0 +1,210 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// DefaultLayout is the Artist/1990-Album/01-Title folder structure
+const DefaultLayout = "{artist}/{year} - {album}/{track} - {title}"
+
+var (
+	layoutPlaceholderRegexp = regexp.MustCompile(`{(\w+)}`)
+	layoutSeparatorRegexp   = regexp.MustCompile(`^[\s.,_-]+$`)
+	layoutNumberPatterns    = map[string]string{
+		"year":  `[(\[<{]?\s*((?:19|20)\d{2})\s*[)\]>}]?`,
+		"disc":  `(\d{1,3})`,
+		"track": `(\d{1,3})`,
+	}
+	layoutTextPlaceholders = []string{"artist", "album", "title", "genre"}
+	discFolderRegexp       = regexp.MustCompile(`(?i)^(?:cd|disc|disk)\s*(\d{1,3})\b`)
+	discPrefixRegexp       = regexp.MustCompile(`^([1-9])-(\d{2,3}[\s.,-].*)$`)
+	defaultLayout          = ProcessErrorArg(ParseLayout(DefaultLayout)).(*Layout)
+)
+
+// Layout is a compiled layout template; the folder levels are matched by the segments in order,
+// the files by the last segment
+type Layout struct {
+	segments    []*layoutSegment
+	artistDepth int
+	albumDepth  int
+}
+
+type layoutSegment struct {
+	regexp       *regexp.Regexp
+	placeholders []string
+	// the whole name is used for this placeholder if the segment does not match
+	primary string
+}
+
+// ParseLayout compiles a template like {artist}/{year} - {album}/{disc}-{track} {title}; a separator
+// next to a number placeholder matches any run of spaces, dots, commas, dashes and underscores, and a segment
+// without placeholders (e.g. a genre folder) only stands for a folder level
+func ParseLayout(template string) (*Layout, error) {
+	layout := &Layout{}
+	for depth, segmentTemplate := range strings.Split(strings.Trim(template, PathSeparator), PathSeparator) {
+		segment := &layoutSegment{}
+		pattern := "(?i)^"
+		literals := layoutPlaceholderRegexp.Split(segmentTemplate, -1)
+		matches := layoutPlaceholderRegexp.FindAllStringSubmatch(segmentTemplate, -1)
+		for i, literal := range literals {
+			nextToNumber := i > 0 && layoutNumberPatterns[matches[i-1][1]] != "" ||
+				i < len(matches) && layoutNumberPatterns[matches[i][1]] != ""
+			if literal != "" && nextToNumber && layoutSeparatorRegexp.MatchString(literal) {
+				pattern += `[\s.,-]+`
+			} else {
+				pattern += strings.Replace(regexp.QuoteMeta(strings.Replace(literal, "_", " ", -1)), " ", `\s+`, -1)
+			}
+			if i == len(matches) {
+				break
+			}
+			placeholder := matches[i][1]
+			if numberPattern, ok := layoutNumberPatterns[placeholder]; ok {
+				pattern += numberPattern
+			} else if !Contains(placeholder, layoutTextPlaceholders...) {
+				return nil, NewError("unknown placeholder in layout %s: {%s}", template, placeholder)
+			} else if i == len(matches)-1 {
+				pattern += `(.*)`
+				segment.primary = placeholder
+			} else {
+				pattern += `(.*?)`
+				segment.primary = placeholder
+			}
+			segment.placeholders = append(segment.placeholders, placeholder)
+			if placeholder == "artist" && layout.artistDepth == 0 {
+				layout.artistDepth = depth + 1
+			} else if placeholder == "album" && layout.albumDepth == 0 {
+				layout.albumDepth = depth + 1
+			}
+		}
+		segment.regexp = regexp.MustCompile(pattern + "$")
+		layout.segments = append(layout.segments, segment)
+	}
+	return layout, nil
+}
+
+// GetLayout returns the layout of the music folder containing the path (or of the music folder root ending with /.)
+func GetLayout(path string) *Layout {
+	musicFolderPath := strings.SplitN(path+PathSeparator, MusicFolderSeparator, 2)[0]
+	for _, musicFolder := range Config.MusicFolders {
+		if filepath.Clean(musicFolder.Path) == musicFolderPath && musicFolder.layout != nil {
+			return musicFolder.layout
+		}
+	}
+	return defaultLayout
+}
+
+// Match fills the tags from the names of the folders and the file of the path, and returns the title of the last
+// part of the path; the disc number is taken from a disc subfolder of the album or a 2-03-Title file name prefix
+func (layout *Layout) Match(pathParts []os.FileInfo) (*Tags, string) {
+	tags := &Tags{}
+	var title string
+	for i, pathPart := range pathParts {
+		name := normalizeName(pathPart.Name())
+		var segment *layoutSegment
+		if pathPart.IsDir() && layout.albumDepth > 0 && i == layout.albumDepth && discFolderRegexp.MatchString(name) {
+			tags.DiscNumber = int(ParseNumber(discFolderRegexp.FindStringSubmatch(name)[1]))
+		} else if pathPart.IsDir() && i < len(layout.segments)-1 {
+			segment = layout.segments[i]
+		} else if !pathPart.IsDir() && i == len(pathParts)-1 {
+			segment = layout.segments[len(layout.segments)-1]
+			name = name[:len(name)-len(filepath.Ext(name))]
+			if match := discPrefixRegexp.FindStringSubmatch(name); match != nil &&
+				!Contains("disc", segment.placeholders...) {
+				tags.DiscNumber = int(ParseNumber(match[1]))
+				name = match[2]
+			}
+		}
+		title = name
+		if segment == nil {
+			continue
+		}
+		values := make(map[string]string)
+		if match := segment.regexp.FindStringSubmatch(name); match != nil {
+			for j, placeholder := range segment.placeholders {
+				values[placeholder] = strings.TrimSpace(match[j+1])
+			}
+		} else if segment.primary != "" {
+			values[segment.primary] = name
+		}
+		for placeholder, value := range values {
+			switch placeholder {
+			case "artist":
+				tags.Artist = value
+			case "album":
+				tags.Album = value
+			case "title":
+				tags.Title = value
+			case "genre":
+				tags.Genre = value
+			case "year":
+				tags.Year = int(ParseNumber(value))
+			case "disc":
+				tags.DiscNumber = int(ParseNumber(value))
+			case "track":
+				tags.Track = int(ParseNumber(value))
+			}
+		}
+		if values[segment.primary] != "" {
+			title = values[segment.primary]
+		}
+	}
+	return tags, title
+}
+
+// IsArtistFolder checks that the path is at the artist level of the layout of its music folder
+func IsArtistFolder(path string) bool {
+	artistDepth := GetLayout(path).artistDepth
+	return artistDepth > 0 && getChildDepth(path) == artistDepth
+}
+
+// IsAlbumFolder checks that the path is at the album level of the layout of its music folder
+func IsAlbumFolder(path string) bool {
+	albumDepth := GetLayout(path).albumDepth
+	return albumDepth > 0 && getChildDepth(path) == albumDepth
+}
+
+// ArtistFolders returns the folders at the artist level of the layout below the folder, ordered by path
+func ArtistFolders(folder string) *PathInfoList {
+	return layoutFolders(folder, GetLayout(folder).artistDepth)
+}
+
+// AlbumFolders returns the folders at the album level of the layout below the folder, ordered by path
+func AlbumFolders(folder string) *PathInfoList {
+	return layoutFolders(folder, GetLayout(folder).albumDepth)
+}
+
+// layoutFolders returns the folders at the depth of the music folder below the folder, ordered by path
+func layoutFolders(folder string, layoutDepth int) *PathInfoList {
+	folders := new(PathInfoList)
+	var readFolders func(folder string, depth int)
+	readFolders = func(folder string, depth int) {
+		for _, entry := range *ReadDir(folder).Filter(true) {
+			if depth == 1 {
+				*folders = append(*folders, entry)
+			} else {
+				readFolders(entry.Path(), depth-1)
+			}
+		}
+	}
+	if depth := layoutDepth - getChildDepth(folder); layoutDepth > 0 && depth > 0 {
+		readFolders(folder, depth)
+	}
+	return folders.SortByPath()
+}
+
+// IsDiscFolder checks that the path is a disc subfolder (CD1, Disc 2...) of an album folder
+func IsDiscFolder(path string) bool {
+	return discFolderRegexp.MatchString(normalizeName(filepath.Base(path))) && IsAlbumFolder(DirName(path))
+}
+
+// AlbumFolder returns the folder of the file, or the album folder if the file is in a disc subfolder
+func AlbumFolder(path string) string {
+	if directory := DirName(path); IsDiscFolder(directory) {
+		return DirName(directory)
+	} else {
+		return directory
+	}
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	libraryFileName = "library.json.gz"
+	// libraryVersion is increased when the scanned tags or children change, so the files are read again
+	libraryVersion = 3
+)
+
+// Library is the in-memory index of the music folders; it is loaded from the state folder at startup,
+// refreshed by the background scanner and saved after every scan
+var Library = &LibraryIndex{}
+
+const librarySaveDelay = time.Minute
+
+type LibraryIndex struct {
+	mutex     sync.RWMutex
+	entries   map[string]*LibraryEntry
+	ready     bool
+	scanning  int32
+	count     int64
+	saveTimer *time.Timer
+}
+
+type librarySnapshot struct {
+	Version int             `json:"version"`
+	Entries []*LibraryEntry `json:"entries"`
+}
+
+// LibraryEntry is a scanned file or folder with the tags and audio properties of the media files, and the child
+// built from them, so the responses are built without reading the disk
+type LibraryEntry struct {
+	Path     string    `json:"path"`
+	Dir      bool      `json:"dir,omitempty"`
+	Length   int64     `json:"size,omitempty"`
+	Modified time.Time `json:"modified"`
+	Tags     *Tags     `json:"tags,omitempty"`
+	PathTags *Tags     `json:"pathTags,omitempty"`
+	Child    *Child    `json:"child,omitempty"`
+}
+
+func (entry *LibraryEntry) Name() string       { return filepath.Base(entry.Path) }
+func (entry *LibraryEntry) Size() int64        { return entry.Length }
+func (entry *LibraryEntry) ModTime() time.Time { return entry.Modified }
+func (entry *LibraryEntry) IsDir() bool        { return entry.Dir }
+func (entry *LibraryEntry) Sys() interface{}   { return nil }
+
+func (entry *LibraryEntry) Mode() os.FileMode {
+	if entry.Dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+// Load reads the saved snapshot of the index, so the requests can be served before the first scan completes
+func (library *LibraryIndex) Load() {
+	libraryFile := filepath.Join(Config.StateFolder, libraryFileName)
+	if !IsExists(libraryFile) {
+		return
+	}
+	file := ProcessErrorArg(os.Open(libraryFile)).(*os.File)
+	defer Close(file)
+	var snapshot librarySnapshot
+	if reader, err := gzip.NewReader(file); err != nil {
+		log.Printf("Library snapshot is unreadable: %v\n", err)
+		return
+	} else if err := json.NewDecoder(reader).Decode(&snapshot); err != nil || snapshot.Version != libraryVersion {
+		log.Printf("Library snapshot is outdated or unreadable, waiting for the scan\n")
+		return
+	}
+	entries := snapshot.Entries
+	library.mutex.Lock()
+	defer library.mutex.Unlock()
+	library.entries = make(map[string]*LibraryEntry, len(entries))
+	for _, entry := range entries {
+		library.entries[entry.Path] = entry
+	}
+	library.ready = true
+	log.Printf("Library snapshot loaded: %d entries\n", len(entries))
+}
+
+// StartScan starts a background scan unless one is already running
+func (library *LibraryIndex) StartScan() {
+	if atomic.CompareAndSwapInt32(&library.scanning, 0, 1) {
+		go library.scan()
+	}
+}
+
+// ScanStatus returns whether a scan is running and the number of the media files scanned so far
+func (library *LibraryIndex) ScanStatus() *ScanStatus {
+	return &ScanStatus{
+		Scanning: atomic.LoadInt32(&library.scanning) == 1,
+		Count:    atomic.LoadInt64(&library.count),
+	}
+}
+
+func (library *LibraryIndex) scan() {
+	defer atomic.StoreInt32(&library.scanning, 0)
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("Library scan failed: %v\n", p)
+		}
+	}()
+	scanStart := time.Now()
+	atomic.StoreInt64(&library.count, 0)
+	entries := make(map[string]*LibraryEntry)
+	var mutex sync.Mutex
+	for _, musicFolder := range Config.MusicFolders {
+		Walk(filepath.Clean(musicFolder.Path)+PathSeparator+".", func(pathInfo *PathInfo) {
+			entry := library.scanEntry(pathInfo)
+			if entry.Tags != nil {
+				atomic.AddInt64(&library.count, 1)
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			entries[entry.Path] = entry
+		})
+	}
+	library.mutex.Lock()
+	library.entries = entries
+	library.ready = true
+	library.mutex.Unlock()
+	scannedEntries := make([]*LibraryEntry, 0, len(entries))
+	for _, entry := range entries {
+		scannedEntries = append(scannedEntries, entry)
+	}
+	library.buildChildren(scannedEntries)
+	LibraryGenres.Reset()
+	library.save()
+	log.Printf("Library scan finished: %d entries, %d media files in %v\n",
+		len(entries), atomic.LoadInt64(&library.count), time.Since(scanStart))
+}
+
+// scanEntry reuses the tags of the indexed entry if the file was not modified since
+func (library *LibraryIndex) scanEntry(pathInfo *PathInfo) *LibraryEntry {
+	entry := &LibraryEntry{
+		Path: pathInfo.Path(), Dir: pathInfo.IsDir(), Length: pathInfo.Size(), Modified: pathInfo.ModTime(),
+	}
+	if entry.Dir {
+		entry.Length = 0
+	} else if Contains(filepath.Ext(entry.Path), mediaFileExtensions...) {
+		if entry.Tags = library.FileTags(entry.Path, pathInfo); entry.Tags == nil {
+			entry.Tags = &Tags{}
+		}
+	}
+	return entry
+}
+
+// Update rescans the changed file or folder, and refreshes the entries of its parent and album folders;
+// a changed cover image or playlist rescans its whole album folder, as the children depend on it
+func (library *LibraryIndex) Update(path string) {
+	invalidateChildCache(path)
+	if !IsMusicFolderPath(path) {
+		return
+	} else if !IsExists(path) {
+		library.Remove(path)
+		return
+	} else if isAlbumResource(path) {
+		path = AlbumFolder(path)
+	}
+	var entries []*LibraryEntry
+	if pathInfo := GetPathInfo(path); pathInfo.IsDir() {
+		var mutex sync.Mutex
+		Walk(path, func(pathInfo *PathInfo) {
+			entry := library.scanEntry(pathInfo)
+			mutex.Lock()
+			defer mutex.Unlock()
+			entries = append(entries, entry)
+		})
+	} else {
+		entries = append(entries, library.scanEntry(pathInfo))
+	}
+	library.index(append(entries, library.scanParents(path)...))
+	LibraryGenres.Update(path)
+}
+
+// Remove drops the deleted or moved file or folder with its content, and refreshes the entries of its parent
+// and album folders
+func (library *LibraryIndex) Remove(path string) {
+	invalidateChildCache(path)
+	if !IsMusicFolderPath(path) {
+		return
+	}
+	library.mutex.Lock()
+	if library.ready {
+		for entryPath := range library.entries {
+			if entryPath == path || strings.HasPrefix(entryPath, path+PathSeparator) {
+				delete(library.entries, entryPath)
+			}
+		}
+		library.scheduleSave()
+	}
+	library.mutex.Unlock()
+	if isAlbumResource(path) && IsExists(AlbumFolder(path)) {
+		library.Update(AlbumFolder(path))
+	} else {
+		library.index(library.scanParents(path))
+		LibraryGenres.Update(path)
+	}
+}
+
+// isAlbumResource checks that the file is a cover image, a playlist or another file of an album folder,
+// which is not a media file
+func isAlbumResource(path string) bool {
+	return filepath.Ext(path) != "" && !Contains(filepath.Ext(path), mediaFileExtensions...) &&
+		(!IsExists(path) || !GetFileInfo(path).IsDir())
+}
+
+// scanParents scans the existing parent and album folders of the path
+func (library *LibraryIndex) scanParents(path string) []*LibraryEntry {
+	var entries []*LibraryEntry
+	for _, parent := range []string{DirName(path), AlbumFolder(path)} {
+		if IsMusicFolderPath(parent) && IsExists(parent) && (len(entries) == 0 || entries[0].Path != parent) {
+			entries = append(entries, library.scanEntry(GetPathInfo(parent)))
+		}
+	}
+	return entries
+}
+
+// index adds the scanned entries to the index and builds their children
+func (library *LibraryIndex) index(entries []*LibraryEntry) {
+	library.mutex.Lock()
+	if !library.ready {
+		library.mutex.Unlock()
+		return
+	}
+	for _, entry := range entries {
+		library.entries[entry.Path] = entry
+	}
+	library.scheduleSave()
+	library.mutex.Unlock()
+	library.buildChildren(entries)
+}
+
+// buildChildren builds the children of the indexed entries, the files before the folders, as the cover art
+// of an album folder depends on the tags of its files
+func (library *LibraryIndex) buildChildren(entries []*LibraryEntry) {
+	sort.SliceStable(entries, func(i, j int) bool { return !entries[i].Dir && entries[j].Dir })
+	for _, entry := range entries {
+		if !strings.Contains(entry.Path, MusicFolderSeparator) {
+			continue
+		}
+		child, pathTags := library.buildChild(entry)
+		if child == nil {
+			continue
+		}
+		indexedEntry := *entry
+		indexedEntry.Child, indexedEntry.PathTags = child, pathTags
+		library.mutex.Lock()
+		if library.entries[entry.Path] == entry {
+			library.entries[entry.Path] = &indexedEntry
+		}
+		library.mutex.Unlock()
+	}
+}
+
+func (library *LibraryIndex) buildChild(entry *LibraryEntry) (child *Child, pathTags *Tags) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("Building the child of %s failed: %v\n", entry.Path, p)
+		}
+	}()
+	child = buildChild(&PathInfo{Parent: DirName(entry.Path), FileInfo: entry}, entry.Tags)
+	return child, child.pathTags
+}
+
+// Child returns the child of the indexed file or folder, or nil if it is not indexed yet or it has changed
+// since (e.g. when the changes are not watched)
+func (library *LibraryIndex) Child(path string) *Child {
+	library.mutex.RLock()
+	entry, ok := library.entries[path]
+	library.mutex.RUnlock()
+	if !ok || entry.Child == nil {
+		return nil
+	} else if fileInfo, err := os.Stat(path); err != nil || !fileInfo.ModTime().Equal(entry.Modified) ||
+		!entry.Dir && fileInfo.Size() != entry.Length {
+		return nil
+	}
+	child := *entry.Child
+	child.Changed = &DateTime{Time: entry.Modified}
+	child.pathTags, child.fileTags = entry.PathTags, entry.Tags
+	return &child
+}
+
+// invalidateChildCache also drops the cached children of the folder of a changed cover image or playlist,
+// as the cover art of the songs next to it depends on it
+func invalidateChildCache(path string) {
+	InvalidateChildCache(path)
+	if filepath.Ext(path) != "" && !Contains(filepath.Ext(path), mediaFileExtensions...) {
+		InvalidateChildCache(DirName(path))
+	}
+}
+
+// IsMusicFolderPath checks that the path is a music folder root (ending with /.) or is inside one
+func IsMusicFolderPath(path string) bool {
+	for _, musicFolder := range Config.MusicFolders {
+		root := filepath.Clean(musicFolder.Path) + PathSeparator + "."
+		if path == root || strings.HasPrefix(path, root+PathSeparator) {
+			return true
+		}
+	}
+	return false
+}
+
+// scheduleSave saves the index a while after the first of a series of changes; the mutex has to be held
+func (library *LibraryIndex) scheduleSave() {
+	if library.saveTimer == nil {
+		library.saveTimer = time.AfterFunc(librarySaveDelay, func() {
+			library.mutex.Lock()
+			library.saveTimer = nil
+			library.mutex.Unlock()
+			defer func() {
+				if p := recover(); p != nil {
+					log.Printf("Saving the library failed: %v\n", p)
+				}
+			}()
+			library.save()
+		})
+	}
+}
+
+func (library *LibraryIndex) save() {
+	library.mutex.RLock()
+	entries := make([]*LibraryEntry, 0, len(library.entries))
+	for _, entry := range library.entries {
+		entries = append(entries, entry)
+	}
+	library.mutex.RUnlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	ProcessError(json.NewEncoder(writer).Encode(&librarySnapshot{Version: libraryVersion, Entries: entries}))
+	ProcessError(writer.Close())
+	ProcessError(os.MkdirAll(Config.StateFolder, 0755))
+	WriteFileAtomic(filepath.Join(Config.StateFolder, libraryFileName), buffer.Bytes())
+}
+
+// FileTags returns the tags and audio properties of the media file from the index, or reads them from the file
+// if it is not indexed or was modified since
+func (library *LibraryIndex) FileTags(path string, fileInfo os.FileInfo) *Tags {
+	library.mutex.RLock()
+	entry, ok := library.entries[path]
+	library.mutex.RUnlock()
+	if ok && entry.Tags != nil && entry.Length == fileInfo.Size() && entry.Modified.Equal(fileInfo.ModTime()) {
+		tags := *entry.Tags
+		return &tags
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("Reading the tags of %s failed: %v\n", path, p)
+		}
+	}()
+	return MergeTags(ReadAudioProperties(path), ReadTags(path))
+}
+
+// LastModified returns the newest modification time of the files and folders of the selected music folders
+func (library *LibraryIndex) LastModified(musicFolderId string) time.Time {
+	var lastModified time.Time
+	var mutex sync.Mutex
+	library.Walk(musicFolderId, func(entry *PathInfo) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if entry.ModTime().After(lastModified) {
+			lastModified = entry.ModTime()
+		}
+	})
+	return lastModified
+}
+
+// Walk calls walkFunc with every file and folder of the selected music folders, from the index if it is ready,
+// otherwise by walking the file system
+func (library *LibraryIndex) Walk(musicFolderId string, walkFunc func(*PathInfo)) {
+	library.mutex.RLock()
+	ready := library.ready
+	var roots []string
+	var entries []*LibraryEntry
+	for i, musicFolder := range Config.MusicFolders {
+		if Contains(musicFolderId, "", strconv.Itoa(i)) {
+			root := filepath.Clean(musicFolder.Path) + PathSeparator + "."
+			roots = append(roots, root)
+			for path, entry := range library.entries {
+				if path == root || strings.HasPrefix(path, root+PathSeparator) {
+					entries = append(entries, entry)
+				}
+			}
+		}
+	}
+	library.mutex.RUnlock()
+	if !ready {
+		for _, root := range roots {
+			Walk(root, walkFunc)
+		}
+		return
+	}
+	for _, entry := range entries {
+		walkFunc(&PathInfo{Parent: DirName(entry.Path), FileInfo: entry})
+	}
+}
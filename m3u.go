@@ -2,10 +2,13 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 )
 
@@ -32,6 +35,8 @@ type ExtendedPlaylistWithSongs struct {
 	DiscogsId     string
 	SpotifyId     string
 	PlaylistWithSongs
+	// compilation is set for the playlists in the artist folder of a compilation (e.g. Various_Artists)
+	compilation bool
 }
 
 func ReadPlaylist(filename string) *ExtendedPlaylistWithSongs {
@@ -43,12 +48,40 @@ func ReadPlaylist(filename string) *ExtendedPlaylistWithSongs {
 	return playlist
 }
 
+// WritePlaylist replaces the playlist file atomically by renaming a fully written temporary file over it
 func WritePlaylist(filename string, playlist *ExtendedPlaylistWithSongs) {
-	file := ProcessErrorArg(os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)).(*os.File)
-	defer Close(file)
 	m3u := M3U{}
-	ProcessErrorArg(file.Write(ProcessErrorArg(m3u.Marshal(playlist)).([]byte)))
-	ProcessError(file.Sync())
+	WriteFileAtomic(filename, ProcessErrorArg(m3u.Marshal(playlist)).([]byte))
+}
+
+// UserPlaylistFolder returns the folder of the playlists owned by the user
+func UserPlaylistFolder(username string) string {
+	return filepath.Clean(Config.PlaylistFolder) + MusicFolderSeparator + username
+}
+
+// IsUserPlaylist checks that the playlist file is directly in the playlist folder of the user
+func IsUserPlaylist(username string, path string) (string, error) {
+	if Config.PlaylistFolder == "" || username == "" ||
+		filepath.Dir(filepath.Clean(path)) != filepath.Clean(UserPlaylistFolder(username)) ||
+		!Contains(filepath.Ext(path), playlistFileExtensions...) {
+		return "", NewError("playlist is not owned by the user")
+	}
+	return path, nil
+}
+
+// NewUserPlaylistFile returns an unused playlist filename in the playlist folder of the user
+func NewUserPlaylistFile(username string, name string) string {
+	folder := UserPlaylistFolder(username)
+	ProcessError(os.MkdirAll(folder, 0755))
+	baseName := strings.TrimLeft(strings.NewReplacer(PathSeparator, "_", "\x00", "_").Replace(m3uLine(name)), ". ")
+	if baseName == "" {
+		baseName = "playlist"
+	}
+	filename := folder + PathSeparator + baseName + ".m3u8"
+	for i := 2; IsExists(filename); i++ {
+		filename = fmt.Sprintf("%s%s%s (%d).m3u8", folder, PathSeparator, baseName, i)
+	}
+	return filename
 }
 
 func (*M3U) NewDecoder(file *os.File) *M3UDecoder {
@@ -61,6 +94,7 @@ func (*M3U) NewDecoder(file *os.File) *M3UDecoder {
 func (decoder *M3UDecoder) Decode(playlist *ExtendedPlaylistWithSongs) error {
 	playlist.Duration = -1
 	playlist.Images = make(map[string]string)
+	playlist.compilation = isCompilationFolder(DirName(decoder.m3uFilename))
 	scanner := bufio.NewScanner(decoder.reader)
 	for scanner.Scan() {
 		line := strings.TrimSpace(scanner.Text())
@@ -81,6 +115,8 @@ func (decoder *M3UDecoder) Decode(playlist *ExtendedPlaylistWithSongs) error {
 			playlist.LastFmId = keyValuePairs["lastfm"]
 			playlist.SpotifyId = keyValuePairs["spotify"]
 			playlist.DiscogsId = keyValuePairs["discogs"]
+			playlist.Comment = keyValuePairs["comment"]
+			playlist.Public = keyValuePairs["public"] == "true"
 		} else if strings.HasPrefix(line, "#EXTIMG:") {
 			imageType := strings.TrimSpace(line[8:])
 			if scanner.Scan() {
@@ -97,18 +133,24 @@ func (decoder *M3UDecoder) Decode(playlist *ExtendedPlaylistWithSongs) error {
 			if scanner.Scan() {
 				entry := strings.TrimSpace(scanner.Text())
 				if child := buildPlaylistChild(DirName(decoder.m3uFilename), entry); child != nil {
-					child.Title = strings.TrimSpace(trackInfo[1])
 					duration, keyValuePairs := removeKeyValuePairs(trackInfo[0])
-					child.Duration = int(ParseNumber(strings.TrimSpace(duration)))
+					child.m3uTags = &Tags{Title: strings.TrimSpace(trackInfo[1])}
+					if playlist.isCompilation() {
+						child.m3uTags.Artist, child.m3uTags.Title = SplitArtistTitle(child.m3uTags.Title)
+					}
+					if duration := int(ParseNumber(strings.TrimSpace(duration))); duration > 0 {
+						child.m3uTags.Duration = duration
+					}
+					if bitrate, ok := keyValuePairs["bitrate"]; ok {
+						child.m3uTags.BitRate = int(ParseNumber(bitrate))
+					}
+					child.updateTags()
 					if child.Duration >= 0 {
 						if playlist.Duration == -1 {
 							playlist.Duration = 0
 						}
 						playlist.Duration += child.Duration
 					}
-					if bitrate, ok := keyValuePairs["bitrate"]; ok {
-						child.BitRate = int(ParseNumber(bitrate))
-					}
 					playlist.Entry = append(playlist.Entry, child)
 				}
 			}
@@ -135,27 +177,95 @@ func (decoder *M3UDecoder) Decode(playlist *ExtendedPlaylistWithSongs) error {
 }
 
 func (*M3U) Marshal(playlist *ExtendedPlaylistWithSongs) ([]byte, error) {
-	// TODO
-	return []byte{}, nil
+	var buffer bytes.Buffer
+	buffer.WriteString("#EXTM3U\n")
+	keyValuePairs := map[string]string{
+		"musicbrainz": playlist.MusicBrainzId,
+		"lastfm":      playlist.LastFmId,
+		"discogs":     playlist.DiscogsId,
+		"spotify":     playlist.SpotifyId,
+		"comment":     playlist.Comment,
+	}
+	if playlist.Public {
+		keyValuePairs["public"] = "true"
+	}
+	buffer.WriteString("#PLAYLIST:" + m3uLine(playlist.Name) + addKeyValuePairs(keyValuePairs) + "\n")
+	if playlist.Artist != "" {
+		buffer.WriteString("#EXTART:" + m3uLine(playlist.Artist) + "\n")
+	}
+	if playlist.Album != "" && playlist.Year > 0 {
+		buffer.WriteString(fmt.Sprintf("#EXTALB:%s (%d)\n", m3uLine(playlist.Album), playlist.Year))
+	} else if playlist.Album != "" {
+		buffer.WriteString("#EXTALB:" + m3uLine(playlist.Album) + "\n")
+	}
+	if playlist.Genre != "" {
+		buffer.WriteString("#EXTGENRE:" + m3uLine(playlist.Genre) + "\n")
+	}
+	imageTypes := make([]string, 0, len(playlist.Images))
+	for imageType := range playlist.Images {
+		imageTypes = append(imageTypes, imageType)
+	}
+	sort.Strings(imageTypes)
+	for _, imageType := range imageTypes {
+		buffer.WriteString("#EXTIMG:" + m3uLine(imageType) + "\n" + playlist.Images[imageType] + "\n")
+	}
+	for _, entry := range playlist.Entry {
+		duration := entry.Duration
+		if duration <= 0 {
+			duration = -1
+		}
+		buffer.WriteString(fmt.Sprintf("#EXTINF:%d", duration))
+		if entry.BitRate > 0 {
+			buffer.WriteString(fmt.Sprintf(" bitrate=\"%d\"", entry.BitRate))
+		}
+		title := entry.Title
+		if entry.Artist != "" && entry.Artist != playlist.Artist && playlist.isCompilation() {
+			title = entry.Artist + " - " + entry.Title
+		}
+		buffer.WriteString("," + m3uLine(title) + "\n" + DecodeId(entry.Id) + "\n")
+	}
+	return buffer.Bytes(), nil
+}
+
+// isCompilation checks that the #EXTINF titles of the playlist are "Artist - Title" display strings
+func (playlist *ExtendedPlaylistWithSongs) isCompilation() bool {
+	return playlist.compilation || IsVariousArtists(playlist.Artist)
+}
+
+// isCompilationFolder checks that the folder is in the artist folder of a compilation
+func isCompilationFolder(folder string) bool {
+	if !strings.Contains(folder, MusicFolderSeparator) || GetLayout(folder).artistDepth == 0 ||
+		getChildDepth(folder) < GetLayout(folder).artistDepth || !IsExists(folder) {
+		return false
+	}
+	return IsVariousArtists(BuildChild(GetPathInfo(folder)).Artist)
 }
 
 func (playlist *ExtendedPlaylistWithSongs) GetPlaylistWithSongs() *PlaylistWithSongs {
 	for _, entry := range playlist.Entry {
-		if playlist.Artist != "" {
-			entry.Artist = playlist.Artist
+		if entry.m3uTags == nil {
+			entry.m3uTags = &Tags{}
+		}
+		if playlist.Artist != "" && entry.m3uTags.Artist == "" && !IsVariousArtists(playlist.Artist) {
+			entry.m3uTags.Artist = playlist.Artist
 		}
 		if playlist.Album != "" {
-			entry.Album = playlist.Album
+			entry.m3uTags.Album = playlist.Album
 		}
 		if playlist.Year > 0 {
-			entry.Year = playlist.Year
+			entry.m3uTags.Year = playlist.Year
 		}
 		if playlist.Genre != "" {
-			entry.Genre = playlist.Genre
+			entry.m3uTags.Genre = playlist.Genre
 		}
+		entry.updateTags()
 		if playlist.MusicBrainzId != "" || playlist.LastFmId != "" {
-			entry.ArtistId = playlist.Id
-			entry.AlbumId = playlist.Id
+			if entry.ArtistId == "" {
+				entry.ArtistId = playlist.Id
+			}
+			if entry.AlbumId == "" {
+				entry.AlbumId = playlist.Id
+			}
 		}
 	}
 	return &playlist.PlaylistWithSongs
@@ -172,6 +282,25 @@ func removeKeyValuePairs(line string) (string, map[string]string) {
 	return line, keyValuePairs
 }
 
+func addKeyValuePairs(keyValuePairs map[string]string) string {
+	keys := make([]string, 0, len(keyValuePairs))
+	for key, value := range keyValuePairs {
+		if value != "" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	var line string
+	for _, key := range keys {
+		line += fmt.Sprintf(" %s=\"%s\"", key, strings.Replace(m3uLine(keyValuePairs[key]), "\"", "'", -1))
+	}
+	return line
+}
+
+func m3uLine(str string) string {
+	return strings.TrimSpace(strings.NewReplacer("\r", " ", "\n", " ").Replace(str))
+}
+
 func buildPlaylistChild(baseDirectory, entry string) *Child {
 	var child *Child
 	if strings.HasPrefix(entry, "http://") || strings.HasPrefix(entry, "https://") {
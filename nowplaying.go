@@ -0,0 +1,81 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// a session is dropped when nothing was streamed for the duration of the song plus this grace period
+const nowPlayingGracePeriod = 10 * time.Minute
+
+var (
+	nowPlayingSessions = make(map[nowPlayingKey]*nowPlayingSession)
+	nowPlayingPlayers  = make(map[nowPlayingKey]int)
+	nowPlayingMutex    sync.Mutex
+)
+
+type nowPlayingKey struct {
+	username string
+	client   string
+}
+
+type nowPlayingSession struct {
+	path     string
+	duration time.Duration
+	started  time.Time
+	updated  time.Time
+}
+
+// UpdateNowPlaying records that the client of the user is playing the file; the start time is kept
+// while the client keeps requesting the same file
+func UpdateNowPlaying(username string, client string, path string, duration int) {
+	nowPlayingMutex.Lock()
+	defer nowPlayingMutex.Unlock()
+	key := nowPlayingKey{username: username, client: client}
+	now := time.Now()
+	if session, ok := nowPlayingSessions[key]; ok && session.path == path {
+		session.updated = now
+	} else {
+		nowPlayingSessions[key] = &nowPlayingSession{
+			path: path, duration: time.Duration(duration) * time.Second, started: now, updated: now,
+		}
+	}
+	if _, ok := nowPlayingPlayers[key]; !ok {
+		nowPlayingPlayers[key] = len(nowPlayingPlayers) + 1
+	}
+	expireNowPlaying(now)
+}
+
+// GetNowPlaying returns the songs played by the active sessions of all the users
+func GetNowPlaying() *NowPlaying {
+	nowPlayingMutex.Lock()
+	defer nowPlayingMutex.Unlock()
+	now := time.Now()
+	expireNowPlaying(now)
+	nowPlaying := &NowPlaying{}
+	for key, session := range nowPlayingSessions {
+		if !IsExists(session.path) {
+			continue
+		}
+		nowPlaying.Entry = append(nowPlaying.Entry, &NowPlayingEntry{
+			Username:   key.username,
+			MinutesAgo: int(now.Sub(session.started).Minutes()),
+			PlayerId:   nowPlayingPlayers[key],
+			PlayerName: key.client,
+			Child:      *BuildChild(GetPathInfo(session.path)),
+		})
+	}
+	sort.Slice(nowPlaying.Entry, func(i, j int) bool {
+		return nowPlaying.Entry[i].PlayerId < nowPlaying.Entry[j].PlayerId
+	})
+	return nowPlaying
+}
+
+func expireNowPlaying(now time.Time) {
+	for key, session := range nowPlayingSessions {
+		if now.Sub(session.updated) > session.duration+nowPlayingGracePeriod {
+			delete(nowPlayingSessions, key)
+		}
+	}
+}
@@ -1,27 +1,21 @@
 package main
 
 import (
-	"bytes"
 	"crypto/md5"
 	"encoding/hex"
 	"encoding/json"
 	"encoding/xml"
 	"fmt"
-	"image"
-	"image/jpeg"
-	"image/png"
-	"io"
 	"log"
 	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
+	"reflect"
 	"runtime/debug"
 	"time"
 )
 
-const coverJpegQuality = 90
-
 type Exchange struct {
 	Request        *http.Request
 	Response       *Response
@@ -86,7 +80,17 @@ func (exchange Exchange) QueryGetInt(key string, defaultValue int) int {
 	return value
 }
 
+// MaxBitRate returns the lower of the requested and the configured bitrate limit of the user (0 means no limit)
+func (exchange Exchange) MaxBitRate(requestedMaxBitRate int) int {
+	maxBitRate := GetUserConfig(exchange.Request.URL.Query().Get("u")).MaxBitRate
+	if requestedMaxBitRate > 0 && (maxBitRate == 0 || requestedMaxBitRate < maxBitRate) {
+		maxBitRate = requestedMaxBitRate
+	}
+	return maxBitRate
+}
+
 func (exchange Exchange) SendResponse() {
+	exchange.decorateResponse()
 	var response []byte
 	if exchange.Request.URL.Query().Get("f") == "json" {
 		exchange.responseWriter.Header().Set("Content-Type", mime.TypeByExtension(".json"))
@@ -99,29 +103,91 @@ func (exchange Exchange) SendResponse() {
 	log.Printf("Response (%d bytes, %v): %s\n\n", n, time.Since(exchange.requestTime), response)
 }
 
+// SendFile serves single and multi-range requests and answers the conditional requests
+// with the ETag and Last-Modified validators derived from the size and the mtime of the file
 func (exchange Exchange) SendFile(filename string) {
 	file := ProcessErrorArg(os.Open(filename)).(*os.File)
+	defer Close(file)
+	fileInfo := ProcessErrorArg(file.Stat()).(os.FileInfo)
 	exchange.responseWriter.Header().Set("Content-Type", mime.TypeByExtension(filepath.Ext(filename)))
-	n := ProcessErrorArg(io.Copy(exchange.responseWriter, file)).(int64)
-	log.Printf("Response (%d bytes, %v): file: %s", n, time.Since(exchange.requestTime), filename)
+	exchange.responseWriter.Header().Set("ETag",
+		fmt.Sprintf("\"%x-%x\"", fileInfo.ModTime().UnixNano(), fileInfo.Size()))
+	responseWriter := &countingResponseWriter{ResponseWriter: exchange.responseWriter}
+	http.ServeContent(responseWriter, exchange.Request, fileInfo.Name(), fileInfo.ModTime(), file)
+	log.Printf("Response (%d, %d bytes, %v): file: %s",
+		responseWriter.status, responseWriter.n, time.Since(exchange.requestTime), filename)
+}
+
+func (exchange Exchange) SendAttachment(filename string) {
+	exchange.responseWriter.Header().Set("Content-Disposition",
+		mime.FormatMediaType("attachment", map[string]string{"filename": filepath.Base(filename)}))
+	exchange.SendFile(filename)
 }
 
-func (exchange Exchange) SendJpeg(img image.Image) {
-	var responseJpeg bytes.Buffer
-	ProcessError(jpeg.Encode(&responseJpeg, img, &jpeg.Options{Quality: coverJpegQuality}))
-	exchange.responseWriter.Header().Set("Content-Type", mime.TypeByExtension(".jpg"))
-	n := ProcessErrorArg(exchange.responseWriter.Write(responseJpeg.Bytes())).(int)
-	log.Printf("Response (%d bytes, %v): jpeg: %d x %d px",
-		n, time.Since(exchange.requestTime), img.Bounds().Size().X, img.Bounds().Size().Y)
+func (exchange Exchange) SendImage(data []byte, contentType string) {
+	exchange.responseWriter.Header().Set("Content-Type", contentType)
+	n := ProcessErrorArg(exchange.responseWriter.Write(data)).(int)
+	log.Printf("Response (%d bytes, %v): image: %s", n, time.Since(exchange.requestTime), contentType)
 }
 
-func (exchange Exchange) SendPng(img image.Image) {
-	var responsePng bytes.Buffer
-	ProcessError(png.Encode(&responsePng, img))
-	exchange.responseWriter.Header().Set("Content-Type", mime.TypeByExtension(".png"))
-	n := ProcessErrorArg(exchange.responseWriter.Write(responsePng.Bytes())).(int)
-	log.Printf("Response (%d bytes, %v): png: %d x %d px",
-		n, time.Since(exchange.requestTime), img.Bounds().Size().X, img.Bounds().Size().Y)
+// decorateResponse fills the user dependent fields of the entries of the response
+func (exchange Exchange) decorateResponse() {
+	username := exchange.Request.URL.Query().Get("u")
+	maxBitRate := exchange.MaxBitRate(0)
+	visitResponse(reflect.ValueOf(exchange.Response.SubsonicResponse), func(entry interface{}) {
+		switch entry := entry.(type) {
+		case *Child:
+			annotation, averageRating := GetAnnotation(username, DecodeId(entry.Id))
+			entry.Starred, entry.UserRating = annotation.StarredDateTime(), UserRating(annotation.Rating)
+			entry.AverageRating, entry.PlayCount = averageRating, annotation.PlayCount
+			entry.BookmarkPosition = annotation.BookmarkPosition()
+			if !entry.IsDir && entry.Suffix != "" {
+				if transcoding, _ := FindTranscoding(entry.Suffix, entry.BitRate, "", maxBitRate); transcoding != nil {
+					entry.TranscodedSuffix = transcoding.Format
+					entry.TranscodedContentType = mime.TypeByExtension("." + transcoding.Format)
+				}
+			}
+		case *Directory:
+			annotation, averageRating := GetAnnotation(username, DecodeId(entry.Id))
+			entry.Starred, entry.UserRating = annotation.StarredDateTime(), UserRating(annotation.Rating)
+			entry.AverageRating, entry.PlayCount = averageRating, annotation.PlayCount
+		case *Artist:
+			annotation, averageRating := GetAnnotation(username, DecodeId(entry.Id))
+			entry.Starred, entry.UserRating = annotation.StarredDateTime(), UserRating(annotation.Rating)
+			entry.AverageRating = averageRating
+		case *ArtistID3:
+			annotation, _ := GetAnnotation(username, DecodeId(entry.Id))
+			entry.Starred = annotation.StarredDateTime()
+		case *AlbumID3:
+			annotation, _ := GetAnnotation(username, DecodeId(entry.Id))
+			entry.Starred, entry.PlayCount = annotation.StarredDateTime(), annotation.PlayCount
+		}
+	})
+}
+
+// visitResponse calls visit with a pointer to every struct in the response tree
+func visitResponse(value reflect.Value, visit func(interface{})) {
+	switch value.Kind() {
+	case reflect.Ptr:
+		if !value.IsNil() {
+			visit(value.Interface())
+			visitResponse(value.Elem(), visit)
+		}
+	case reflect.Slice:
+		for i := 0; i < value.Len(); i++ {
+			visitResponse(value.Index(i), visit)
+		}
+	case reflect.Struct:
+		for i := 0; i < value.NumField(); i++ {
+			if field := value.Field(i); value.Type().Field(i).PkgPath != "" {
+				continue
+			} else if field.Kind() == reflect.Struct && field.CanAddr() {
+				visitResponse(field.Addr(), visit)
+			} else {
+				visitResponse(field, visit)
+			}
+		}
+	}
 }
 
 func (exchange Exchange) SendError(code int, message string) {
@@ -130,6 +196,26 @@ func (exchange Exchange) SendError(code int, message string) {
 	exchange.SendResponse()
 }
 
+type countingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	n      int64
+}
+
+func (writer *countingResponseWriter) WriteHeader(status int) {
+	writer.status = status
+	writer.ResponseWriter.WriteHeader(status)
+}
+
+func (writer *countingResponseWriter) Write(data []byte) (int, error) {
+	if writer.status == 0 {
+		writer.status = http.StatusOK
+	}
+	n, err := writer.ResponseWriter.Write(data)
+	writer.n += int64(n)
+	return n, err
+}
+
 func verifyCredentials(exchange Exchange) bool {
 	var (
 		username = exchange.Request.URL.Query().Get("u")
@@ -5,8 +5,10 @@ package main
 import (
 	"encoding/xml"
 	"sort"
+	"strings"
 	"time"
 	"unicode"
+	"unicode/utf8"
 )
 
 const (
@@ -39,6 +41,7 @@ type SubsonicResponse struct {
 	Genres                *Genres                `xml:"genres" json:"genres,omitempty"`
 	Artists               *ArtistsID3            `xml:"artists" json:"artists,omitempty"`
 	Artist                *ArtistWithAlbumsID3   `xml:"artist" json:"artist,omitempty"`
+	Album                 *AlbumWithSongsID3     `xml:"album" json:"album,omitempty"`
 	Song                  *Child                 `xml:"song" json:"song,omitempty"`
 	Videos                *Videos                `xml:"videos" json:"videos,omitempty"`
 	VideoInfo             *VideoInfo             `xml:"videoInfo" json:"videoInfo,omitempty"`
@@ -126,8 +129,9 @@ type Genres struct {
 }
 
 type Genre struct {
-	SongCount  int `xml:"songCount,attr" json:"songCount"`
-	AlbumCount int `xml:"albumCount,attr" json:"albumCount"`
+	Value      string `xml:",chardata" json:"value"`
+	SongCount  int    `xml:"songCount,attr" json:"songCount"`
+	AlbumCount int    `xml:"albumCount,attr" json:"albumCount"`
 }
 
 type ArtistsID3 struct {
@@ -169,6 +173,11 @@ type AlbumID3 struct {
 	Genre     string    `xml:"genre,attr,omitempty" json:"genre,omitempty"`
 }
 
+type AlbumWithSongsID3 struct {
+	Song []*Child `xml:"song" json:"song,omitempty"`
+	AlbumID3
+}
+
 type Videos struct {
 	Video []*Child `xml:"video" json:"video,omitempty"`
 }
@@ -241,6 +250,9 @@ type Child struct {
 	BookmarkPosition      int64         `xml:"bookmarkPosition,attr,omitempty" json:"bookmarkPosition,omitempty"`
 	OriginalWidth         int           `xml:"originalWidth,attr,omitempty" json:"originalWidth,omitempty"`
 	OriginalHeight        int           `xml:"originalHeight,attr,omitempty" json:"originalHeight,omitempty"`
+	pathTags              *Tags
+	fileTags              *Tags
+	m3uTags               *Tags
 }
 
 type NowPlaying struct {
@@ -391,7 +403,7 @@ type Bookmark struct {
 
 type PlayQueue struct {
 	Entry     []*Child  `xml:"entry" json:"entry,omitempty"`
-	Current   int       `xml:"current,attr,omitempty" json:"current,omitempty"`
+	Current   string    `xml:"current,attr,omitempty" json:"current,omitempty"`
 	Position  int64     `xml:"position,attr,omitempty" json:"position,omitempty"`
 	Username  string    `xml:"username,attr" json:"username"`
 	Changed   *DateTime `xml:"changed,attr" json:"changed"`
@@ -533,15 +545,55 @@ func (indexes *Indexes) Sort() {
 	})
 	for _, index := range indexes.Index {
 		sort.Slice(index.Artist, func(i, j int) bool {
-			return index.Artist[i].Name < index.Artist[j].Name
+			return strings.ToLower(sortName(index.Artist[i].Name)) < strings.ToLower(sortName(index.Artist[j].Name))
 		})
 	}
 }
 
 func (artist *Artist) IndexName() string {
-	name := rune(artist.Name[0])
-	if !unicode.IsLetter(name) {
+	return indexName(artist.Name)
+}
+
+func (artists *ArtistsID3) AddArtist(artist *ArtistID3) {
+	indexName := artist.IndexName()
+	for _, index := range artists.Index {
+		if index.Name == indexName {
+			index.Artist = append(index.Artist, artist)
+			return
+		}
+	}
+	artists.Index = append(artists.Index, &IndexID3{Name: indexName, Artist: []*ArtistID3{artist}})
+}
+
+func (artists *ArtistsID3) Sort() {
+	sort.Slice(artists.Index, func(i, j int) bool {
+		return artists.Index[i].Name < artists.Index[j].Name
+	})
+	for _, index := range artists.Index {
+		sort.Slice(index.Artist, func(i, j int) bool {
+			return strings.ToLower(sortName(index.Artist[i].Name)) < strings.ToLower(sortName(index.Artist[j].Name))
+		})
+	}
+}
+
+func (artist *ArtistID3) IndexName() string {
+	return indexName(artist.Name)
+}
+
+// sortName strips the leading ignored article, so "The Beatles" is indexed and ordered as "Beatles"
+func sortName(name string) string {
+	for _, article := range strings.Fields(Config.IgnoredArticles) {
+		if len(name) > len(article)+1 && strings.EqualFold(name[:len(article)], article) && name[len(article)] == ' ' {
+			return strings.TrimSpace(name[len(article)+1:])
+		}
+	}
+	return name
+}
+
+func indexName(name string) string {
+	first, _ := utf8.DecodeRuneInString(sortName(name))
+	if !unicode.IsLetter(first) {
 		return "#"
 	}
-	return string(unicode.ToUpper(name))
+	return string(unicode.ToUpper(first))
 }
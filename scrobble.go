@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	ScrobblerListenBrainz = "listenbrainz"
+	ScrobblerLastFm       = "lastfm"
+	listenRetryInterval   = 5 * time.Minute
+)
+
+var (
+	scrobblerDefaultUrls = map[string]string{
+		ScrobblerListenBrainz: "https://api.listenbrainz.org/1/submit-listens",
+		ScrobblerLastFm:       "https://ws.audioscrobbler.com/2.0/",
+	}
+	scrobblerClient = &http.Client{Timeout: 10 * time.Second}
+	listenQueued    = make(chan struct{}, 1)
+)
+
+// Listen is a play waiting to be forwarded to a scrobbler of the user
+type Listen struct {
+	Scrobbler string    `json:"scrobbler"`
+	Artist    string    `json:"artist"`
+	Album     string    `json:"album,omitempty"`
+	Title     string    `json:"title"`
+	Duration  int       `json:"duration,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// scrobblerError is a rejected submission which is not worth retrying
+type scrobblerError struct {
+	status string
+}
+
+func (e *scrobblerError) Error() string {
+	return "submission rejected: " + e.status
+}
+
+// RecordPlay increments the play count and updates the last played time of the song and its album folder
+func RecordPlay(username string, path string, played time.Time) {
+	UpdateUserState(username, func(state *UserState) {
+		for _, path := range []string{path, AlbumFolder(path)} {
+			annotation := state.Annotation(path)
+			annotation.PlayCount++
+			if annotation.Played == nil || played.After(*annotation.Played) {
+				annotation.Played = &played
+			}
+		}
+	})
+}
+
+// QueueListen queues the play for every scrobbler of the user and wakes up the forwarder
+func QueueListen(username string, child *Child, played time.Time) {
+	user := GetUserConfig(username)
+	if len(user.Scrobblers) == 0 {
+		return
+	}
+	UpdateUserState(username, func(state *UserState) {
+		for _, scrobbler := range user.Scrobblers {
+			state.Listens = append(state.Listens, &Listen{Scrobbler: scrobbler.Url,
+				Artist: child.Artist, Album: child.Album, Title: child.Title, Duration: child.Duration, Time: played})
+		}
+	})
+	select {
+	case listenQueued <- struct{}{}:
+	default:
+	}
+}
+
+// ForwardListens submits the queued listens when a new one is queued, and retries the failed ones periodically
+func ForwardListens() {
+	ticker := time.NewTicker(listenRetryInterval)
+	for {
+		forwardQueuedListens()
+		select {
+		case <-listenQueued:
+		case <-ticker.C:
+		}
+	}
+}
+
+func forwardQueuedListens() {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("Forwarding listens failed: %v\n", p)
+		}
+	}()
+	for _, user := range Config.Users {
+		var listens []*Listen
+		ReadUserState(user.Username, func(state *UserState) {
+			listens = append(listens, state.Listens...)
+		})
+		if len(listens) == 0 {
+			continue
+		}
+		done := make(map[*Listen]bool)
+		unreachable := make(map[string]bool)
+		for _, listen := range listens {
+			scrobbler := user.scrobbler(listen.Scrobbler)
+			if scrobbler == nil {
+				done[listen] = true
+			} else if unreachable[listen.Scrobbler] {
+				continue
+			} else if err := scrobbler.submit(listen); err == nil {
+				done[listen] = true
+			} else if _, rejected := err.(*scrobblerError); rejected {
+				log.Printf("Listen of %s dropped by %s: %v\n", listen.Title, listen.Scrobbler, err)
+				done[listen] = true
+			} else {
+				log.Printf("Scrobbler %s is unreachable, retrying later: %v\n", listen.Scrobbler, err)
+				unreachable[listen.Scrobbler] = true
+			}
+		}
+		UpdateUserState(user.Username, func(state *UserState) {
+			var queued []*Listen
+			for _, listen := range state.Listens {
+				if !done[listen] {
+					queued = append(queued, listen)
+				}
+			}
+			state.Listens = queued
+		})
+	}
+}
+
+func (user *UserConfig) scrobbler(scrobblerUrl string) *ScrobblerConfig {
+	for _, scrobbler := range user.Scrobblers {
+		if scrobbler.Url == scrobblerUrl {
+			return scrobbler
+		}
+	}
+	return nil
+}
+
+func (scrobbler *ScrobblerConfig) submit(listen *Listen) error {
+	var request *http.Request
+	var err error
+	switch scrobbler.Type {
+	case ScrobblerListenBrainz:
+		trackMetadata := map[string]interface{}{"artist_name": listen.Artist, "track_name": listen.Title}
+		if listen.Album != "" {
+			trackMetadata["release_name"] = listen.Album
+		}
+		if listen.Duration > 0 {
+			trackMetadata["additional_info"] = map[string]int{"duration_ms": listen.Duration * 1000}
+		}
+		body := ProcessErrorArg(json.Marshal(map[string]interface{}{
+			"listen_type": "single",
+			"payload": []interface{}{map[string]interface{}{
+				"listened_at":    listen.Time.Unix(),
+				"track_metadata": trackMetadata,
+			}},
+		})).([]byte)
+		if request, err = http.NewRequest(http.MethodPost, scrobbler.Url, bytes.NewReader(body)); err != nil {
+			return err
+		}
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("Authorization", "Token "+scrobbler.Token)
+	case ScrobblerLastFm:
+		params := url.Values{
+			"method":    {"track.scrobble"},
+			"artist":    {listen.Artist},
+			"track":     {listen.Title},
+			"timestamp": {strconv.FormatInt(listen.Time.Unix(), 10)},
+			"api_key":   {scrobbler.ApiKey},
+			"sk":        {scrobbler.SessionKey},
+		}
+		if listen.Album != "" {
+			params.Set("album", listen.Album)
+		}
+		if listen.Duration > 0 {
+			params.Set("duration", strconv.Itoa(listen.Duration))
+		}
+		params.Set("api_sig", lastFmSignature(params, scrobbler.ApiSecret))
+		params.Set("format", "json")
+		if request, err = http.NewRequest(http.MethodPost, scrobbler.Url,
+			bytes.NewBufferString(params.Encode())); err != nil {
+			return err
+		}
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	default:
+		return &scrobblerError{status: "unknown scrobbler type " + scrobbler.Type}
+	}
+	response, err := scrobblerClient.Do(request)
+	if err != nil {
+		return err
+	}
+	Close(response.Body)
+	if response.StatusCode >= 500 || response.StatusCode == http.StatusTooManyRequests {
+		return NewError("%s", response.Status)
+	} else if response.StatusCode >= 300 {
+		return &scrobblerError{status: response.Status}
+	}
+	return nil
+}
+
+// lastFmSignature signs the parameters as described in the Last.fm API authentication spec
+func lastFmSignature(params url.Values, secret string) string {
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var signature string
+	for _, key := range keys {
+		signature += key + params.Get(key)
+	}
+	return fmt.Sprintf("%x", md5.Sum([]byte(signature+secret)))
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var searchTermReplacer = strings.NewReplacer("\"", " ", "*", " ", "%", " ")
+
+type SearchResults struct {
+	Artists PathInfoList
+	Albums  PathInfoList
+	Songs   PathInfoList
+}
+
+// SearchMusicFolders walks the selected music folders and collects the folders at the artist and album levels
+// of their layouts and the media files whose normalized name contains all the query terms
+func SearchMusicFolders(musicFolderId string, query string) *SearchResults {
+	results := &SearchResults{}
+	terms := SearchTerms(query)
+	var mutex sync.Mutex
+	Library.Walk(musicFolderId, func(entry *PathInfo) {
+		if entry.Name() == "." {
+			return
+		}
+		name := entry.Name()
+		if !entry.IsDir() {
+			if !Contains(filepath.Ext(name), mediaFileExtensions...) {
+				return
+			}
+			name = name[:len(name)-len(filepath.Ext(name))]
+		}
+		if !MatchesSearchTerms(name, terms) {
+			return
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		if !entry.IsDir() {
+			results.Songs = append(results.Songs, entry)
+		} else if IsArtistFolder(entry.Path()) {
+			results.Artists = append(results.Artists, entry)
+		} else if IsAlbumFolder(entry.Path()) {
+			results.Albums = append(results.Albums, entry)
+		}
+	})
+	results.Artists.SortByPath()
+	results.Albums.SortByPath()
+	results.Songs.SortByPath()
+	return results
+}
+
+func SearchTerms(query string) []string {
+	return strings.Fields(strings.ToLower(normalizeName(searchTermReplacer.Replace(query))))
+}
+
+func MatchesSearchTerms(name string, terms []string) bool {
+	name = strings.ToLower(normalizeName(name))
+	for _, term := range terms {
+		if !strings.Contains(name, term) {
+			return false
+		}
+	}
+	return true
+}
+
+func (pathInfoList *PathInfoList) SortByPath() *PathInfoList {
+	sort.Slice(*pathInfoList, func(i, j int) bool {
+		return (*pathInfoList)[i].Path() < (*pathInfoList)[j].Path()
+	})
+	return pathInfoList
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"image"
 	"log"
 	"log/syslog"
 	"math"
@@ -11,9 +10,10 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
-	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -27,8 +27,6 @@ var (
 	videoFileExtensions    = []string{".mp4", ".m4v", ".mpg", ".webm", ".mkv", ".avi", ".wmv", ".flv", ".mov", ".3gp"}
 	mediaFileExtensions    = append(musicFileExtensions, videoFileExtensions...)
 	playlistFileExtensions = []string{".m3u", ".m3u8"}
-	leadingYearRegexp      = regexp.MustCompile(`^[(\[<{]?\s*((?:19|20)\d{2})\s*[)\]>}]?[\s.,-]+(.*)$`)
-	leadingTrackRegexp     = regexp.MustCompile(`^(\d{1,3})[\s.,-]+(.*)$`)
 )
 
 func main() {
@@ -37,20 +35,55 @@ func main() {
 	RegisterHandler("/rest/getMusicFolders.view", getMusicFolders)
 	RegisterHandler("/rest/getIndexes.view", getIndexes)
 	RegisterHandler("/rest/getMusicDirectory.view", getMusicDirectory)
+	RegisterHandler("/rest/getArtists.view", getArtists)
+	RegisterHandler("/rest/getArtist.view", getArtist)
+	RegisterHandler("/rest/getAlbum.view", getAlbum)
+	RegisterHandler("/rest/getSong.view", getSong)
 	RegisterHandler("/rest/getArtistInfo.view", getArtistInfo)
 	RegisterHandler("/rest/getAlbumList.view", getAlbumList)
+	RegisterHandler("/rest/getAlbumList2.view", getAlbumList2)
 	RegisterHandler("/rest/getRandomSongs.view", getRandomSongs)
+	RegisterHandler("/rest/getGenres.view", getGenres)
+	RegisterHandler("/rest/getSongsByGenre.view", getSongsByGenre)
+	RegisterHandler("/rest/search.view", search)
+	RegisterHandler("/rest/search2.view", search2)
+	RegisterHandler("/rest/search3.view", search3)
 	RegisterHandler("/rest/getPlaylists.view", getPlaylists)
 	RegisterHandler("/rest/getPlaylist.view", getPlaylist)
+	RegisterHandler("/rest/createPlaylist.view", createPlaylist)
+	RegisterHandler("/rest/updatePlaylist.view", updatePlaylist)
+	RegisterHandler("/rest/deletePlaylist.view", deletePlaylist)
+	RegisterHandler("/rest/star.view", star)
+	RegisterHandler("/rest/unstar.view", unstar)
+	RegisterHandler("/rest/setRating.view", setRating)
+	RegisterHandler("/rest/getStarred.view", getStarred)
+	RegisterHandler("/rest/getStarred2.view", getStarred2)
+	RegisterHandler("/rest/scrobble.view", scrobble)
+	RegisterHandler("/rest/getNowPlaying.view", getNowPlaying)
 	RegisterHandler("/rest/stream.view", stream)
-	RegisterHandler("/rest/download.view", stream)
+	RegisterHandler("/rest/download.view", download)
 	RegisterHandler("/rest/getCoverArt.view", getCoverArt)
 	RegisterHandler("/rest/jukeboxControl.view", jukeboxControl)
 	RegisterHandler("/rest/getInternetRadioStations.view", getInternetRadioStations)
 	RegisterHandler("/rest/getUser.view", getUser)
+	RegisterHandler("/rest/getScanStatus.view", getScanStatus)
+	RegisterHandler("/rest/startScan.view", startScan)
 	RegisterHandler("/rest/savePlayQueue.view", savePlayQueue)
+	RegisterHandler("/rest/getPlayQueue.view", getPlayQueue)
+	RegisterHandler("/rest/getBookmarks.view", getBookmarks)
+	RegisterHandler("/rest/createBookmark.view", createBookmark)
+	RegisterHandler("/rest/deleteBookmark.view", deleteBookmark)
 	RegisterHandler("/rest/", unimplemented)
 	http.HandleFunc("/", unhandled)
+	go ForwardListens()
+	Library.Load()
+	Library.StartScan()
+	go WatchLibrary()
+	if Config.MPD != nil {
+		for _, user := range Config.Users {
+			GetJukebox(user.Username)
+		}
+	}
 	server := http.Server{
 		Addr:         Config.Server.ListenAddress,
 		ReadTimeout:  5 * time.Second,
@@ -83,17 +116,32 @@ func getMusicFolders(exchange Exchange) {
 }
 
 func getIndexes(exchange Exchange) {
-	exchange.Response.Indexes = &Indexes{LastModified: 0, IgnoredArticles: ""}
+	lastModified := Library.LastModified(exchange.Request.URL.Query().Get("musicFolderId")).UnixNano() /
+		int64(time.Millisecond)
+	exchange.Response.Indexes = &Indexes{LastModified: lastModified, IgnoredArticles: Config.IgnoredArticles}
+	ifModifiedSince, err := strconv.ParseInt(exchange.Request.URL.Query().Get("ifModifiedSince"), 10, 64)
+	if err == nil && lastModified <= ifModifiedSince {
+		exchange.SendResponse()
+		return
+	}
 	for i, musicFolder := range Config.MusicFolders {
 		if Contains(exchange.Request.URL.Query().Get("musicFolderId"), "", strconv.Itoa(i)) {
-			for _, entry := range *ReadDir(filepath.Clean(musicFolder.Path)+PathSeparator+".").
-				Filter(true, mediaFileExtensions...).Sort() {
-				child := BuildChild(entry)
-				if child.IsDir {
-					exchange.Response.Indexes.AddArtist(&Artist{Id: child.Id, Name: child.Artist})
-				} else {
-					exchange.Response.Indexes.Child = append(exchange.Response.Indexes.Child, child)
+			root := filepath.Clean(musicFolder.Path) + PathSeparator + "."
+			// the artist folders of the layout, or the top folders if it has no artist level
+			folders := ArtistFolders(root)
+			if GetLayout(root).artistDepth == 0 {
+				folders = ReadDir(root).Filter(true)
+			}
+			for _, folder := range *folders {
+				child := BuildChild(folder)
+				name := child.Artist
+				if name == "" {
+					name = child.Title
 				}
+				exchange.Response.Indexes.AddArtist(&Artist{Id: child.Id, Name: name})
+			}
+			for _, entry := range *ReadDir(root).Filter(false, mediaFileExtensions...).Sort() {
+				exchange.Response.Indexes.Child = append(exchange.Response.Indexes.Child, BuildChild(entry))
 			}
 		}
 	}
@@ -116,21 +164,79 @@ func getMusicDirectory(exchange Exchange) {
 			exchange.Response.Directory.Child = playlist.Entry
 			exchange.Response.Directory.Name = playlist.Name
 		} else {
-			for _, entry := range *ReadDir(baseDirectory).Filter(true, mediaFileExtensions...).Sort() {
-				child := BuildChild(entry)
-				exchange.Response.Directory.Child = append(exchange.Response.Directory.Child, child)
+			for _, entry := range *ReadDir(baseDirectory).Filter(true).Sort() {
+				if !IsDiscFolder(entry.Path()) {
+					exchange.Response.Directory.Child = append(exchange.Response.Directory.Child, BuildChild(entry))
+				}
 			}
+			exchange.Response.Directory.Child = append(exchange.Response.Directory.Child,
+				ReadDirectorySongs(baseDirectory)...)
 		}
-		if Config.MPD != nil && IsExists(Config.MPD.UnixSocket) {
-			for _, child := range exchange.Response.Directory.Child {
-				if !child.IsDir && child.Duration == 0 {
-					func() {
-						mpd := NewMPD(Config.MPD.UnixSocket)
-						defer mpd.Disconnect()
-						info := mpd.Info(DecodeId(child.Id))
-						child.Duration = int(math.Round(ParseNumber(string(info["duration"]))))
-					}()
-				}
+		exchange.SendResponse()
+	}
+}
+
+func getArtists(exchange Exchange) {
+	exchange.Response.Artists = &ArtistsID3{IgnoredArticles: Config.IgnoredArticles}
+	var artists PathInfoList
+	var mutex sync.Mutex
+	Library.Walk(exchange.Request.URL.Query().Get("musicFolderId"), func(entry *PathInfo) {
+		if entry.IsDir() && IsArtistFolder(entry.Path()) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			artists = append(artists, entry)
+		}
+	})
+	for _, artist := range artists {
+		exchange.Response.Artists.AddArtist(BuildArtistID3(artist))
+	}
+	exchange.Response.Artists.Sort()
+	exchange.SendResponse()
+}
+
+func getArtist(exchange Exchange) {
+	if artistDirectory, err := IsAllowedPath(DecodeId(exchange.Request.URL.Query().Get("id"))); err != nil {
+		exchange.SendError(0, err.Error())
+	} else if !IsExists(artistDirectory) {
+		exchange.SendError(70, "Artist not found")
+	} else {
+		exchange.Response.Artist = &ArtistWithAlbumsID3{ArtistID3: *BuildArtistID3(GetPathInfo(artistDirectory))}
+		for _, album := range *AlbumFolders(artistDirectory) {
+			exchange.Response.Artist.Album = append(exchange.Response.Artist.Album, BuildAlbumID3(album))
+		}
+		exchange.SendResponse()
+	}
+}
+
+func getAlbum(exchange Exchange) {
+	if albumDirectory, err := IsAllowedPath(DecodeId(exchange.Request.URL.Query().Get("id"))); err != nil {
+		exchange.SendError(0, err.Error())
+	} else if !IsExists(albumDirectory) {
+		exchange.SendError(70, "Album not found")
+	} else {
+		exchange.Response.Album = &AlbumWithSongsID3{
+			AlbumID3: *BuildAlbumID3(GetPathInfo(albumDirectory)),
+			Song:     ReadDirectorySongs(albumDirectory),
+		}
+		if exchange.Response.Album.Duration == 0 {
+			for _, song := range exchange.Response.Album.Song {
+				exchange.Response.Album.Duration += song.Duration
+			}
+		}
+		exchange.SendResponse()
+	}
+}
+
+func getSong(exchange Exchange) {
+	if file, err := IsAllowedPath(DecodeId(exchange.Request.URL.Query().Get("id"))); err != nil {
+		exchange.SendError(0, err.Error())
+	} else if !IsExists(file) {
+		exchange.SendError(70, "Song not found")
+	} else {
+		exchange.Response.Song = BuildChild(GetPathInfo(file))
+		for _, song := range ReadDirectorySongs(AlbumFolder(file)) {
+			if song.Id == exchange.Response.Song.Id {
+				exchange.Response.Song = song
 			}
 		}
 		exchange.SendResponse()
@@ -141,7 +247,7 @@ func getArtistInfo(exchange Exchange) {
 	exchange.Response.ArtistInfo = &ArtistInfo{}
 	if baseDirectory, err := IsAllowedPath(DecodeId(exchange.Request.URL.Query().Get("id"))); err != nil {
 		exchange.SendError(0, err.Error())
-	} else if coverArtImage := baseDirectory + PathSeparator + "folder.jpg"; IsExists(coverArtImage) {
+	} else if coverArtImage := FindArtistImage(baseDirectory); coverArtImage != "" {
 		exchange.Response.ArtistInfo.SmallImageUrl = buildGetCoverArtUrl(exchange, coverArtImage, 64)
 		exchange.Response.ArtistInfo.MediumImageUrl = buildGetCoverArtUrl(exchange, coverArtImage, 126)
 		exchange.Response.ArtistInfo.LargeImageUrl = buildGetCoverArtUrl(exchange, coverArtImage, 0)
@@ -164,16 +270,36 @@ func buildGetCoverArtUrl(exchange Exchange, coverArtImage string, size int) *str
 }
 
 func getAlbumList(exchange Exchange) {
-	albums := new(PathInfoList)
-	for i, musicFolder := range Config.MusicFolders {
-		if Contains(exchange.Request.URL.Query().Get("musicFolderId"), "", strconv.Itoa(i)) {
-			for _, artist := range *ReadDir(filepath.Clean(musicFolder.Path) + PathSeparator + ".").Filter(true) {
-				for _, album := range *ReadDir(artist.Parent + PathSeparator + artist.Name()).Filter(true) {
-					*albums = append(*albums, album)
-				}
-			}
+	if albums := listAlbums(exchange); albums != nil {
+		exchange.Response.AlbumList = &AlbumList{}
+		for _, album := range *albums {
+			exchange.Response.AlbumList.Album = append(exchange.Response.AlbumList.Album, BuildChild(album))
 		}
+		exchange.SendResponse()
 	}
+}
+
+func getAlbumList2(exchange Exchange) {
+	if albums := listAlbums(exchange); albums != nil {
+		exchange.Response.AlbumList2 = &AlbumList2{}
+		for _, album := range *albums {
+			exchange.Response.AlbumList2.Album = append(exchange.Response.AlbumList2.Album, BuildAlbumID3(album))
+		}
+		exchange.SendResponse()
+	}
+}
+
+func listAlbums(exchange Exchange) *PathInfoList {
+	albums := new(PathInfoList)
+	var mutex sync.Mutex
+	Library.Walk(exchange.Request.URL.Query().Get("musicFolderId"), func(entry *PathInfo) {
+		if entry.IsDir() && entry.Name() != "." && IsAlbumFolder(entry.Path()) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			*albums = append(*albums, entry)
+		}
+	})
+	albums.SortByPath()
 	switch exchange.Request.URL.Query().Get("type") {
 	case "alphabeticalByName":
 		albums.SortByChild(func(i, j *Child) bool { return i.Album < j.Album })
@@ -193,30 +319,59 @@ func getAlbumList(exchange Exchange) {
 		albums.SortByChild(func(i, j *Child) bool { return i.Created.After(j.Created.Time) })
 	case "random":
 		albums.Shuffle()
-	case "highest" /* Top rated */, "starred", "recent" /* Recently played */, "frequent" /* Most played */, "byGenre":
-		exchange.SendError(30, "Not yet implemented!")
-		return
-	}
-	size := exchange.QueryGetInt("size", 10)
-	offset := exchange.QueryGetInt("offset", 0)
-	exchange.Response.AlbumList = &AlbumList{}
-	for i, offsetEnd := offset, Min(offset+size, len(*albums)-offset); i < offsetEnd; i++ {
-		exchange.Response.AlbumList.Album = append(exchange.Response.AlbumList.Album, BuildChild((*albums)[i]))
+	case "highest" /* Top rated */ :
+		averageRatings := make(map[string]AverageRating)
+		for _, album := range *albums {
+			_, averageRatings[album.Path()] = GetAnnotation(exchange.Request.URL.Query().Get("u"), album.Path())
+		}
+		albums.FilterByChild(func(child *Child) bool { return averageRatings[DecodeId(child.Id)] > 0 }).
+			SortByChild(func(i, j *Child) bool { return averageRatings[DecodeId(i.Id)] > averageRatings[DecodeId(j.Id)] })
+	case "starred":
+		starred := make(map[string]*DateTime)
+		for _, album := range *albums {
+			annotation, _ := GetAnnotation(exchange.Request.URL.Query().Get("u"), album.Path())
+			starred[album.Path()] = annotation.StarredDateTime()
+		}
+		albums.FilterByChild(func(child *Child) bool { return starred[DecodeId(child.Id)] != nil }).
+			SortByChild(func(i, j *Child) bool { return starred[DecodeId(i.Id)].After(starred[DecodeId(j.Id)].Time) })
+	case "recent" /* Recently played */ :
+		played := make(map[string]*time.Time)
+		for _, album := range *albums {
+			annotation, _ := GetAnnotation(exchange.Request.URL.Query().Get("u"), album.Path())
+			played[album.Path()] = annotation.Played
+		}
+		albums.FilterByChild(func(child *Child) bool { return played[DecodeId(child.Id)] != nil }).
+			SortByChild(func(i, j *Child) bool { return played[DecodeId(i.Id)].After(*played[DecodeId(j.Id)]) })
+	case "frequent" /* Most played */ :
+		playCounts := make(map[string]int64)
+		for _, album := range *albums {
+			annotation, _ := GetAnnotation(exchange.Request.URL.Query().Get("u"), album.Path())
+			playCounts[album.Path()] = annotation.PlayCount
+		}
+		albums.FilterByChild(func(child *Child) bool { return playCounts[DecodeId(child.Id)] > 0 }).
+			SortByChild(func(i, j *Child) bool { return playCounts[DecodeId(i.Id)] > playCounts[DecodeId(j.Id)] })
+	case "byGenre":
+		genre := exchange.Request.URL.Query().Get("genre")
+		if genre == "" {
+			exchange.SendError(10, "Required parameter is missing: genre")
+			return nil
+		}
+		genreAlbums := LibraryGenres.Index(exchange.Request.URL.Query().Get("musicFolderId")).Albums[genre]
+		albums.FilterByChild(func(child *Child) bool { return genreAlbums[DecodeId(child.Id)] })
 	}
-	exchange.SendResponse()
+	return albums.Page(exchange.QueryGetInt("offset", 0), exchange.QueryGetInt("size", 10))
 }
 
 func getRandomSongs(exchange Exchange) {
 	var songs PathInfoList
-	for i, musicFolder := range Config.MusicFolders {
-		if Contains(exchange.Request.URL.Query().Get("musicFolderId"), "", strconv.Itoa(i)) {
-			Walk(filepath.Clean(musicFolder.Path)+PathSeparator+".", func(entry *PathInfo) {
-				if !entry.IsDir() && Contains(filepath.Ext(entry.Name()), musicFileExtensions...) {
-					songs = append(songs, entry)
-				}
-			})
+	var mutex sync.Mutex
+	Library.Walk(exchange.Request.URL.Query().Get("musicFolderId"), func(entry *PathInfo) {
+		if !entry.IsDir() && Contains(filepath.Ext(entry.Name()), musicFileExtensions...) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			songs = append(songs, entry)
 		}
-	}
+	})
 	exchange.Response.RandomSongs = &Songs{}
 	for i, size := 0, exchange.QueryGetInt("size", 10); i < size; i++ {
 		exchange.Response.RandomSongs.Song = append(exchange.Response.RandomSongs.Song,
@@ -225,6 +380,82 @@ func getRandomSongs(exchange Exchange) {
 	exchange.SendResponse()
 }
 
+func getGenres(exchange Exchange) {
+	exchange.Response.Genres = LibraryGenres.Index(exchange.Request.URL.Query().Get("musicFolderId")).Genres()
+	exchange.SendResponse()
+}
+
+func getSongsByGenre(exchange Exchange) {
+	songs := LibraryGenres.Index(exchange.Request.URL.Query().Get("musicFolderId")).
+		Songs[exchange.Request.URL.Query().Get("genre")]
+	offset := Min(Max(exchange.QueryGetInt("offset", 0), 0), len(songs))
+	count := Min(Max(exchange.QueryGetInt("count", 10), 0), 500)
+	exchange.Response.SongsByGenre = &Songs{Song: songs[offset:Min(offset+count, len(songs))]}
+	exchange.SendResponse()
+}
+
+func search(exchange Exchange) {
+	var (
+		artist    = SearchTerms(exchange.Request.URL.Query().Get("artist"))
+		album     = SearchTerms(exchange.Request.URL.Query().Get("album"))
+		title     = SearchTerms(exchange.Request.URL.Query().Get("title"))
+		anyField  = SearchTerms(exchange.Request.URL.Query().Get("any"))
+		newerThan = time.Unix(0, int64(exchange.QueryGetInt("newerThan", 0))*int64(time.Millisecond))
+		offset    = exchange.QueryGetInt("offset", 0)
+	)
+	songs := SearchMusicFolders(exchange.Request.URL.Query().Get("musicFolderId"), "").Songs
+	songs.FilterByChild(func(child *Child) bool {
+		return MatchesSearchTerms(child.Artist, artist) && MatchesSearchTerms(child.Album, album) &&
+			MatchesSearchTerms(child.Title, title) && !child.Created.Before(newerThan) &&
+			MatchesSearchTerms(child.Artist+" "+child.Album+" "+child.Title, anyField)
+	})
+	exchange.Response.SearchResult = &SearchResult{Offset: offset, TotalHit: len(songs)}
+	for _, song := range *songs.Page(offset, exchange.QueryGetInt("count", 20)) {
+		exchange.Response.SearchResult.Match = append(exchange.Response.SearchResult.Match, BuildChild(song))
+	}
+	exchange.SendResponse()
+}
+
+func search2(exchange Exchange) {
+	results := SearchMusicFolders(exchange.Request.URL.Query().Get("musicFolderId"),
+		exchange.Request.URL.Query().Get("query"))
+	exchange.Response.SearchResult2 = &SearchResult2{}
+	for _, artist := range *results.Artists.Page(
+		exchange.QueryGetInt("artistOffset", 0), exchange.QueryGetInt("artistCount", 20)) {
+		child := BuildChild(artist)
+		exchange.Response.SearchResult2.Artist = append(exchange.Response.SearchResult2.Artist,
+			&Artist{Id: child.Id, Name: child.Artist, Starred: child.Starred, UserRating: child.UserRating})
+	}
+	for _, album := range *results.Albums.Page(
+		exchange.QueryGetInt("albumOffset", 0), exchange.QueryGetInt("albumCount", 20)) {
+		exchange.Response.SearchResult2.Album = append(exchange.Response.SearchResult2.Album, BuildChild(album))
+	}
+	for _, song := range *results.Songs.Page(
+		exchange.QueryGetInt("songOffset", 0), exchange.QueryGetInt("songCount", 20)) {
+		exchange.Response.SearchResult2.Song = append(exchange.Response.SearchResult2.Song, BuildChild(song))
+	}
+	exchange.SendResponse()
+}
+
+func search3(exchange Exchange) {
+	results := SearchMusicFolders(exchange.Request.URL.Query().Get("musicFolderId"),
+		exchange.Request.URL.Query().Get("query"))
+	exchange.Response.SearchResult3 = &SearchResult3{}
+	for _, artist := range *results.Artists.Page(
+		exchange.QueryGetInt("artistOffset", 0), exchange.QueryGetInt("artistCount", 20)) {
+		exchange.Response.SearchResult3.Artist = append(exchange.Response.SearchResult3.Artist, BuildArtistID3(artist))
+	}
+	for _, album := range *results.Albums.Page(
+		exchange.QueryGetInt("albumOffset", 0), exchange.QueryGetInt("albumCount", 20)) {
+		exchange.Response.SearchResult3.Album = append(exchange.Response.SearchResult3.Album, BuildAlbumID3(album))
+	}
+	for _, song := range *results.Songs.Page(
+		exchange.QueryGetInt("songOffset", 0), exchange.QueryGetInt("songCount", 20)) {
+		exchange.Response.SearchResult3.Song = append(exchange.Response.SearchResult3.Song, BuildChild(song))
+	}
+	exchange.SendResponse()
+}
+
 func getPlaylists(exchange Exchange) {
 	exchange.Response.Playlists = &Playlists{}
 	userPlaylistFolder := filepath.Clean(Config.PlaylistFolder) +
@@ -232,7 +463,6 @@ func getPlaylists(exchange Exchange) {
 	for _, playlistFile := range *ReadDir(userPlaylistFolder).Filter(false, playlistFileExtensions...).Sort() {
 		playlistWithSongs := ReadPlaylist(filepath.Join(userPlaylistFolder, playlistFile.Name())).GetPlaylistWithSongs()
 		playlistWithSongs.Owner = exchange.Request.URL.Query().Get("u")
-		playlistWithSongs.Public = false
 		exchange.Response.Playlists.Playlist = append(exchange.Response.Playlists.Playlist, &playlistWithSongs.Playlist)
 	}
 	exchange.SendResponse()
@@ -247,11 +477,240 @@ func getPlaylist(exchange Exchange) {
 	}
 }
 
+func createPlaylist(exchange Exchange) {
+	query := exchange.Request.URL.Query()
+	var playlistFile string
+	playlist := &ExtendedPlaylistWithSongs{}
+	if playlistId := query.Get("playlistId"); playlistId != "" {
+		file, err := IsUserPlaylist(query.Get("u"), DecodeId(playlistId))
+		if err != nil {
+			exchange.SendError(50, err.Error())
+			return
+		} else if !IsExists(file) {
+			exchange.SendError(70, "Playlist not found")
+			return
+		}
+		playlistFile, playlist = file, ReadPlaylist(file)
+		playlist.Entry = nil
+	} else if name := query.Get("name"); name != "" {
+		playlistFile = NewUserPlaylistFile(query.Get("u"), name)
+		playlist.Name = name
+	} else {
+		exchange.SendError(10, "Required parameter is missing: playlistId or name")
+		return
+	}
+	if songs, err := buildPlaylistSongs(query["songId"]); err != nil {
+		exchange.SendError(70, err.Error())
+	} else {
+		playlist.Entry = songs
+		WritePlaylist(playlistFile, playlist)
+		exchange.Response.Playlist = ReadPlaylist(playlistFile).GetPlaylistWithSongs()
+		exchange.Response.Playlist.Owner = query.Get("u")
+		exchange.SendResponse()
+	}
+}
+
+func updatePlaylist(exchange Exchange) {
+	query := exchange.Request.URL.Query()
+	if file, err := IsUserPlaylist(query.Get("u"), DecodeId(query.Get("playlistId"))); err != nil {
+		exchange.SendError(50, err.Error())
+	} else if !IsExists(file) {
+		exchange.SendError(70, "Playlist not found")
+	} else if songs, err := buildPlaylistSongs(query["songIdToAdd"]); err != nil {
+		exchange.SendError(70, err.Error())
+	} else {
+		playlist := ReadPlaylist(file)
+		if _, ok := query["name"]; ok {
+			playlist.Name = query.Get("name")
+		}
+		if _, ok := query["comment"]; ok {
+			playlist.Comment = query.Get("comment")
+		}
+		if _, ok := query["public"]; ok {
+			playlist.Public = query.Get("public") == "true"
+		}
+		removedIndexes := make(map[int]bool)
+		for _, index := range query["songIndexToRemove"] {
+			removedIndexes[int(ParseNumber(index))] = true
+		}
+		var entries []*Child
+		for i, entry := range playlist.Entry {
+			if !removedIndexes[i] {
+				entries = append(entries, entry)
+			}
+		}
+		playlist.Entry = append(entries, songs...)
+		WritePlaylist(file, playlist)
+		exchange.SendResponse()
+	}
+}
+
+func deletePlaylist(exchange Exchange) {
+	if file, err := IsUserPlaylist(exchange.Request.URL.Query().Get("u"),
+		DecodeId(exchange.Request.URL.Query().Get("id"))); err != nil {
+		exchange.SendError(50, err.Error())
+	} else if !IsExists(file) {
+		exchange.SendError(70, "Playlist not found")
+	} else {
+		ProcessError(os.Remove(file))
+		exchange.SendResponse()
+	}
+}
+
+func buildPlaylistSongs(songIds []string) ([]*Child, error) {
+	var songs []*Child
+	for _, songId := range songIds {
+		if file, err := IsAllowedPath(DecodeId(songId)); err != nil {
+			return nil, err
+		} else if !IsExists(file) {
+			return nil, NewError("Song not found: %s", songId)
+		} else {
+			songs = append(songs, BuildChild(GetPathInfo(file)))
+		}
+	}
+	return songs, nil
+}
+
+func star(exchange Exchange) {
+	starred := time.Now()
+	exchange.annotate(func(annotation *Annotation) { annotation.Starred = &starred })
+}
+
+func unstar(exchange Exchange) {
+	exchange.annotate(func(annotation *Annotation) { annotation.Starred = nil })
+}
+
+func setRating(exchange Exchange) {
+	if rating := exchange.QueryGetInt("rating", -1); rating < 0 || rating > 5 {
+		exchange.SendError(10, "Rating has to be between 0 and 5")
+	} else {
+		exchange.annotate(func(annotation *Annotation) { annotation.Rating = rating })
+	}
+}
+
+// annotate applies the change on the annotations of the files and folders selected by the id, albumId
+// and artistId parameters
+func (exchange Exchange) annotate(change func(*Annotation)) {
+	query := exchange.Request.URL.Query()
+	var paths []string
+	for _, id := range append(append(query["id"], query["albumId"]...), query["artistId"]...) {
+		if path, err := IsAllowedPath(DecodeId(id)); err != nil {
+			exchange.SendError(0, err.Error())
+			return
+		} else if !IsExists(path) {
+			exchange.SendError(70, "File not found")
+			return
+		} else {
+			paths = append(paths, path)
+		}
+	}
+	UpdateUserState(query.Get("u"), func(state *UserState) {
+		for _, path := range paths {
+			change(state.Annotation(path))
+		}
+	})
+	exchange.SendResponse()
+}
+
+func getStarred(exchange Exchange) {
+	starred := StarredMusicFolders(exchange.Request.URL.Query().Get("u"),
+		exchange.Request.URL.Query().Get("musicFolderId"))
+	exchange.Response.Starred = &Starred{}
+	for _, artist := range starred.Artists {
+		child := BuildChild(artist)
+		exchange.Response.Starred.Artist = append(exchange.Response.Starred.Artist,
+			&Artist{Id: child.Id, Name: child.Artist})
+	}
+	for _, album := range starred.Albums {
+		exchange.Response.Starred.Album = append(exchange.Response.Starred.Album, BuildChild(album))
+	}
+	for _, song := range starred.Songs {
+		exchange.Response.Starred.Song = append(exchange.Response.Starred.Song, BuildChild(song))
+	}
+	exchange.SendResponse()
+}
+
+func getStarred2(exchange Exchange) {
+	starred := StarredMusicFolders(exchange.Request.URL.Query().Get("u"),
+		exchange.Request.URL.Query().Get("musicFolderId"))
+	exchange.Response.Starred2 = &Starred2{}
+	for _, artist := range starred.Artists {
+		exchange.Response.Starred2.Artist = append(exchange.Response.Starred2.Artist, BuildArtistID3(artist))
+	}
+	for _, album := range starred.Albums {
+		exchange.Response.Starred2.Album = append(exchange.Response.Starred2.Album, BuildAlbumID3(album))
+	}
+	for _, song := range starred.Songs {
+		exchange.Response.Starred2.Song = append(exchange.Response.Starred2.Song, BuildChild(song))
+	}
+	exchange.SendResponse()
+}
+
+func scrobble(exchange Exchange) {
+	query := exchange.Request.URL.Query()
+	var files []string
+	for _, id := range query["id"] {
+		if file, err := IsAllowedPath(DecodeId(id)); err != nil {
+			exchange.SendError(0, err.Error())
+			return
+		} else if !IsExists(file) {
+			exchange.SendError(70, "File not found")
+			return
+		} else {
+			files = append(files, file)
+		}
+	}
+	if query.Get("submission") == "false" {
+		for _, file := range files {
+			UpdateNowPlaying(query.Get("u"), query.Get("c"), file, BuildChild(GetPathInfo(file)).Duration)
+		}
+	} else {
+		for i, file := range files {
+			played := time.Now()
+			if i < len(query["time"]) {
+				played = time.Unix(0, int64(ParseNumber(query["time"][i]))*int64(time.Millisecond))
+			}
+			RecordPlay(query.Get("u"), file, played)
+			QueueListen(query.Get("u"), BuildChild(GetPathInfo(file)), played)
+		}
+	}
+	exchange.SendResponse()
+}
+
+func getNowPlaying(exchange Exchange) {
+	exchange.Response.NowPlaying = GetNowPlaying()
+	exchange.SendResponse()
+}
+
 func stream(exchange Exchange) {
 	if file, err := IsAllowedPath(DecodeId(exchange.Request.URL.Query().Get("id"))); err != nil {
 		exchange.SendError(0, err.Error())
+	} else if !IsExists(file) {
+		exchange.SendError(70, "File not found")
 	} else {
-		exchange.SendFile(file)
+		child := BuildChild(GetPathInfo(file))
+		UpdateNowPlaying(exchange.Request.URL.Query().Get("u"), exchange.Request.URL.Query().Get("c"),
+			file, child.Duration)
+		maxBitRate := exchange.MaxBitRate(exchange.QueryGetInt("maxBitRate", 0))
+		if transcoding, bitRate := FindTranscoding(child.Suffix, child.BitRate,
+			exchange.Request.URL.Query().Get("format"), maxBitRate); transcoding == nil {
+			exchange.SendFile(file)
+		} else {
+			timeOffset := exchange.QueryGetInt("timeOffset", 0)
+			var contentLength int64
+			if exchange.Request.URL.Query().Get("estimateContentLength") == "true" {
+				contentLength = EstimateContentLength(child.Duration-timeOffset, bitRate)
+			}
+			exchange.SendTranscoded(file, transcoding, bitRate, timeOffset, contentLength)
+		}
+	}
+}
+
+func download(exchange Exchange) {
+	if file, err := IsAllowedPath(DecodeId(exchange.Request.URL.Query().Get("id"))); err != nil {
+		exchange.SendError(0, err.Error())
+	} else {
+		exchange.SendAttachment(file)
 	}
 }
 
@@ -260,28 +719,17 @@ func getCoverArt(exchange Exchange) {
 	if strings.HasPrefix(coverArtId, "pl-") {
 		coverArtId = coverArtId[3:]
 	}
+	size := ParseNumber(exchange.Request.URL.Query().Get("size"))
 	if file, err := IsAllowedPath(DecodeId(coverArtId)); err != nil {
 		exchange.SendError(0, err.Error())
+	} else if Contains(filepath.Ext(file), mediaFileExtensions...) && !HasEmbeddedCover(file) {
+		exchange.SendError(70, "Cover art not found")
+	} else if !math.IsNaN(size) && !strings.EqualFold(filepath.Ext(file), ".webp") {
+		exchange.SendFile(CachedCover(file, int(math.Min(size, maxCoverSize))))
+	} else if data, contentType := ReadCover(file); !strings.HasPrefix(contentType, "image/") {
+		exchange.SendError(70, "Cover art not found")
 	} else {
-		var coverArt image.Image
-		if Contains(filepath.Ext(file), playlistFileExtensions...) {
-			coverArt = GenerateCover("TODO")
-		} else {
-			coverArt = OpenImage(file)
-		}
-		coverArtSize := float64(coverArt.Bounds().Size().X)
-		if size := ParseNumber(exchange.Request.URL.Query().Get("size")); !math.IsNaN(size) && size != coverArtSize {
-			interpolation := NearestNeighbor
-			if size > coverArtSize {
-				interpolation = Bilinear
-			}
-			coverArt = ResizeImage(coverArt, size/coverArtSize, interpolation)
-		}
-		if Contains(filepath.Ext(file), playlistFileExtensions...) {
-			exchange.SendPng(coverArt)
-		} else {
-			exchange.SendJpeg(coverArt)
-		}
+		exchange.SendImage(data, contentType)
 	}
 }
 
@@ -301,36 +749,42 @@ func jukeboxControl(exchange Exchange) {
 			files = append(files, file)
 		}
 	}
-	jukebox := NewJukebox()
-	defer jukebox.Disconnect()
+	jukebox := GetJukebox(exchange.Request.URL.Query().Get("u"))
+	var err error
 	switch action {
 	case "add":
-		jukebox.Add(files...)
+		err = jukebox.Add(files...)
 	case "set":
-		jukebox.Set(files...)
+		err = jukebox.Set(files...)
 	case "start":
-		jukebox.Start()
+		err = jukebox.Start()
 	case "stop":
-		jukebox.Stop()
+		err = jukebox.Stop()
 	case "skip":
-		status := jukebox.Status()
-		jukebox.Skip(int(ParseNumber(index)), int(ParseNumber(offset)))
-		if exchange.Request.URL.Query().Get("c") == "DSub" && status.State == "stop" {
-			jukebox.Stop()
+		var status *JukeboxStatus
+		if status, err = jukebox.Status(); err == nil {
+			err = jukebox.Skip(int(ParseNumber(index)), int(ParseNumber(offset)))
+		}
+		if err == nil && exchange.Request.URL.Query().Get("c") == "DSub" && status.State == "stop" {
+			err = jukebox.Stop()
 		}
 	case "clear":
-		jukebox.Clear()
+		err = jukebox.Clear()
 	case "remove":
-		jukebox.Remove(int(ParseNumber(index)))
+		err = jukebox.Remove(int(ParseNumber(index)))
 	case "shuffle":
-		jukebox.Shuffle()
+		err = jukebox.Shuffle()
 	case "setGain":
-		jukebox.SetGain(float32(ParseNumber(gain)))
+		err = jukebox.SetGain(float32(ParseNumber(gain)))
 	}
-	if action == "get" {
-		exchange.Response.JukeboxPlaylist = jukebox.Playlist()
-	} else {
-		exchange.Response.JukeboxStatus = jukebox.Status()
+	if err == nil && action == "get" {
+		exchange.Response.JukeboxPlaylist, err = jukebox.Playlist()
+	} else if err == nil {
+		exchange.Response.JukeboxStatus, err = jukebox.Status()
+	}
+	if err != nil {
+		exchange.SendError(0, err.Error())
+		return
 	}
 	exchange.SendResponse()
 }
@@ -354,15 +808,131 @@ func getInternetRadioStations(exchange Exchange) {
 
 func getUser(exchange Exchange) {
 	exchange.Response.User = &User{
-		Username: exchange.Request.URL.Query().Get("u"), ScrobblingEnabled: false, AdminRole: true,
+		Username: exchange.Request.URL.Query().Get("u"), ScrobblingEnabled: true, AdminRole: true,
 		SettingsRole: true, DownloadRole: true, UploadRole: true, PlaylistRole: true, CoverArtRole: true,
 		CommentRole: true, PodcastRole: true, StreamRole: true, ShareRole: false,
-		JukeboxRole: Config.MPD != nil && IsExists(Config.MPD.UnixSocket),
+		JukeboxRole: Config.MPD != nil && (mpdNetwork(Config.MPD.Address) == "tcp" ||
+			strings.HasPrefix(Config.MPD.Address, "@") || IsExists(Config.MPD.Address)),
+	}
+	exchange.SendResponse()
+}
+
+func getBookmarks(exchange Exchange) {
+	username := exchange.Request.URL.Query().Get("u")
+	exchange.Response.Bookmarks = &Bookmarks{}
+	ReadUserState(username, func(state *UserState) {
+		for path, annotation := range state.Annotations {
+			if annotation.Bookmark != nil && IsExists(path) {
+				exchange.Response.Bookmarks.Bookmark = append(exchange.Response.Bookmarks.Bookmark, &Bookmark{
+					Entry:    []*Child{BuildChild(GetPathInfo(path))},
+					Position: annotation.Bookmark.Position,
+					Username: username,
+					Comment:  annotation.Bookmark.Comment,
+					Created:  &DateTime{annotation.Bookmark.Created},
+					Changed:  &DateTime{annotation.Bookmark.Changed},
+				})
+			}
+		}
+	})
+	bookmarks := exchange.Response.Bookmarks.Bookmark
+	sort.Slice(bookmarks, func(i, j int) bool { return bookmarks[i].Changed.After(bookmarks[j].Changed.Time) })
+	exchange.SendResponse()
+}
+
+func createBookmark(exchange Exchange) {
+	query := exchange.Request.URL.Query()
+	if file, err := IsAllowedPath(DecodeId(query.Get("id"))); err != nil {
+		exchange.SendError(0, err.Error())
+	} else if !IsExists(file) {
+		exchange.SendError(70, "File not found")
+	} else if _, ok := query["position"]; !ok {
+		exchange.SendError(10, "Required parameter is missing: position")
+	} else {
+		now := time.Now()
+		UpdateUserState(query.Get("u"), func(state *UserState) {
+			annotation := state.Annotation(file)
+			if annotation.Bookmark == nil {
+				annotation.Bookmark = &SavedBookmark{Created: now}
+			}
+			annotation.Bookmark.Position = int64(ParseNumber(query.Get("position")))
+			annotation.Bookmark.Comment = query.Get("comment")
+			annotation.Bookmark.Changed = now
+		})
+		exchange.SendResponse()
+	}
+}
+
+func deleteBookmark(exchange Exchange) {
+	if file, err := IsAllowedPath(DecodeId(exchange.Request.URL.Query().Get("id"))); err != nil {
+		exchange.SendError(0, err.Error())
+	} else {
+		UpdateUserState(exchange.Request.URL.Query().Get("u"), func(state *UserState) {
+			state.Annotation(file).Bookmark = nil
+		})
+		exchange.SendResponse()
 	}
+}
+
+func getScanStatus(exchange Exchange) {
+	exchange.Response.ScanStatus = Library.ScanStatus()
+	exchange.SendResponse()
+}
+
+func startScan(exchange Exchange) {
+	Library.StartScan()
+	exchange.Response.ScanStatus = Library.ScanStatus()
 	exchange.SendResponse()
 }
 
 func savePlayQueue(exchange Exchange) {
+	query := exchange.Request.URL.Query()
+	playQueue := &SavedPlayQueue{
+		Position: int64(exchange.QueryGetInt("position", 0)), Changed: time.Now(), ChangedBy: query.Get("c"),
+	}
+	for _, id := range query["id"] {
+		if file, err := IsAllowedPath(DecodeId(id)); err != nil {
+			exchange.SendError(0, err.Error())
+			return
+		} else {
+			playQueue.Entries = append(playQueue.Entries, file)
+		}
+	}
+	if current := query.Get("current"); current != "" {
+		playQueue.Current = DecodeId(current)
+	}
+	UpdateUserState(query.Get("u"), func(state *UserState) {
+		if len(playQueue.Entries) == 0 {
+			state.PlayQueue = nil
+		} else {
+			state.PlayQueue = playQueue
+		}
+	})
+	exchange.SendResponse()
+}
+
+func getPlayQueue(exchange Exchange) {
+	var playQueue SavedPlayQueue
+	ReadUserState(exchange.Request.URL.Query().Get("u"), func(state *UserState) {
+		if state.PlayQueue != nil {
+			playQueue = *state.PlayQueue
+		}
+	})
+	if len(playQueue.Entries) > 0 {
+		exchange.Response.PlayQueue = &PlayQueue{
+			Position:  playQueue.Position,
+			Username:  exchange.Request.URL.Query().Get("u"),
+			Changed:   &DateTime{playQueue.Changed},
+			ChangedBy: playQueue.ChangedBy,
+		}
+		for _, file := range playQueue.Entries {
+			if IsExists(file) {
+				exchange.Response.PlayQueue.Entry = append(exchange.Response.PlayQueue.Entry, BuildChild(GetPathInfo(file)))
+			}
+		}
+		if IsExists(playQueue.Current) {
+			exchange.Response.PlayQueue.Current = EncodeId(playQueue.Current)
+		}
+	}
 	exchange.SendResponse()
 }
 
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	userStates     = make(map[string]*UserState)
+	userStateMutex sync.Mutex
+)
+
+// UserState holds the persistent data of a user, stored as a json file in the state folder
+type UserState struct {
+	Annotations map[string]*Annotation `json:"annotations,omitempty"`
+	Listens     []*Listen              `json:"listens,omitempty"`
+	PlayQueue   *SavedPlayQueue        `json:"playQueue,omitempty"`
+}
+
+// SavedPlayQueue is the play queue of the user; the entries are stored by the path behind the id
+type SavedPlayQueue struct {
+	Entries   []string  `json:"entries"`
+	Current   string    `json:"current,omitempty"`
+	Position  int64     `json:"position,omitempty"`
+	Changed   time.Time `json:"changed"`
+	ChangedBy string    `json:"changedBy,omitempty"`
+}
+
+// Annotation holds the user data of a file or folder; the annotations are keyed by the path behind the id
+type Annotation struct {
+	Starred   *time.Time     `json:"starred,omitempty"`
+	Rating    int            `json:"rating,omitempty"`
+	PlayCount int64          `json:"playCount,omitempty"`
+	Played    *time.Time     `json:"played,omitempty"`
+	Bookmark  *SavedBookmark `json:"bookmark,omitempty"`
+}
+
+type SavedBookmark struct {
+	Position int64     `json:"position"`
+	Comment  string    `json:"comment,omitempty"`
+	Created  time.Time `json:"created"`
+	Changed  time.Time `json:"changed"`
+}
+
+// ReadUserState calls read with the state of the user; the state must not be kept or modified
+func ReadUserState(username string, read func(*UserState)) {
+	userStateMutex.Lock()
+	defer userStateMutex.Unlock()
+	read(loadUserState(username))
+}
+
+// UpdateUserState calls update with the state of the user, then writes the state file
+func UpdateUserState(username string, update func(*UserState)) {
+	userStateMutex.Lock()
+	defer userStateMutex.Unlock()
+	state := loadUserState(username)
+	update(state)
+	for path, annotation := range state.Annotations {
+		if *annotation == (Annotation{}) {
+			delete(state.Annotations, path)
+		}
+	}
+	ProcessError(os.MkdirAll(Config.StateFolder, 0755))
+	WriteFileAtomic(userStateFile(username), ProcessErrorArg(json.MarshalIndent(state, "", "  ")).([]byte))
+}
+
+func loadUserState(username string) *UserState {
+	if state, ok := userStates[username]; ok {
+		return state
+	}
+	state := &UserState{}
+	if file := userStateFile(username); IsExists(file) {
+		ProcessError(json.Unmarshal(ProcessErrorArg(ioutil.ReadFile(file)).([]byte), state))
+	}
+	if state.Annotations == nil {
+		state.Annotations = make(map[string]*Annotation)
+	}
+	userStates[username] = state
+	return state
+}
+
+func userStateFile(username string) string {
+	return filepath.Join(Config.StateFolder, username+".json")
+}
+
+// Annotation returns the annotation of the path, creating an empty one if it does not exist yet
+func (state *UserState) Annotation(path string) *Annotation {
+	annotation, ok := state.Annotations[path]
+	if !ok {
+		annotation = &Annotation{}
+		state.Annotations[path] = annotation
+	}
+	return annotation
+}
+
+// GetAnnotation returns the annotation of the path for the user, and the average rating given by all the users
+func GetAnnotation(username string, path string) (Annotation, AverageRating) {
+	userStateMutex.Lock()
+	defer userStateMutex.Unlock()
+	var annotation Annotation
+	if userAnnotation, ok := loadUserState(username).Annotations[path]; ok {
+		annotation = *userAnnotation
+	}
+	var ratingSum, ratingCount int
+	for _, user := range Config.Users {
+		if userAnnotation, ok := loadUserState(user.Username).Annotations[path]; ok && userAnnotation.Rating > 0 {
+			ratingSum += userAnnotation.Rating
+			ratingCount++
+		}
+	}
+	if ratingCount == 0 {
+		return annotation, 0
+	}
+	return annotation, AverageRating(float64(ratingSum) / float64(ratingCount))
+}
+
+func (annotation Annotation) BookmarkPosition() int64 {
+	if annotation.Bookmark == nil {
+		return 0
+	}
+	return annotation.Bookmark.Position
+}
+
+func (annotation Annotation) StarredDateTime() *DateTime {
+	if annotation.Starred == nil {
+		return nil
+	}
+	return &DateTime{*annotation.Starred}
+}
+
+// StarredMusicFolders returns the existing artist folders, album folders and media files starred by the user
+// in the selected music folders
+func StarredMusicFolders(username string, musicFolderId string) *SearchResults {
+	var paths []string
+	ReadUserState(username, func(state *UserState) {
+		for path, annotation := range state.Annotations {
+			if annotation.Starred != nil {
+				paths = append(paths, path)
+			}
+		}
+	})
+	sort.Strings(paths)
+	results := &SearchResults{}
+	for i, musicFolder := range Config.MusicFolders {
+		if !Contains(musicFolderId, "", strconv.Itoa(i)) {
+			continue
+		}
+		musicFolderPrefix := filepath.Clean(musicFolder.Path) + MusicFolderSeparator
+		for _, path := range paths {
+			if !strings.HasPrefix(path, musicFolderPrefix) || !IsExists(path) {
+				continue
+			}
+			entry := GetPathInfo(path)
+			if !entry.IsDir() {
+				if Contains(filepath.Ext(path), mediaFileExtensions...) {
+					results.Songs = append(results.Songs, entry)
+				}
+			} else if IsArtistFolder(path) {
+				results.Artists = append(results.Artists, entry)
+			} else if IsAlbumFolder(path) {
+				results.Albums = append(results.Albums, entry)
+			}
+		}
+	}
+	return results
+}
@@ -0,0 +1,912 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	TagsSourcePath = "path"
+	TagsSourceFile = "tags"
+	TagsSourceM3U  = "m3u"
+)
+
+// tagsSources are the known tags sources in their default order of precedence
+var tagsSources = []string{TagsSourceM3U, TagsSourceFile, TagsSourcePath}
+
+var id3v1Genres = []string{
+	"Blues", "Classic Rock", "Country", "Dance", "Disco", "Funk", "Grunge", "Hip-Hop", "Jazz", "Metal",
+	"New Age", "Oldies", "Other", "Pop", "R&B", "Rap", "Reggae", "Rock", "Techno", "Industrial",
+	"Alternative", "Ska", "Death Metal", "Pranks", "Soundtrack", "Euro-Techno", "Ambient", "Trip-Hop", "Vocal",
+	"Jazz+Funk", "Fusion", "Trance", "Classical", "Instrumental", "Acid", "House", "Game", "Sound Clip",
+	"Gospel", "Noise", "AlternRock", "Bass", "Soul", "Punk", "Space", "Meditative", "Instrumental Pop",
+	"Instrumental Rock", "Ethnic", "Gothic", "Darkwave", "Techno-Industrial", "Electronic", "Pop-Folk",
+	"Eurodance", "Dream", "Southern Rock", "Comedy", "Cult", "Gangsta", "Top 40", "Christian Rap", "Pop/Funk",
+	"Jungle", "Native American", "Cabaret", "New Wave", "Psychadelic", "Rave", "Showtunes", "Trailer", "Lo-Fi",
+	"Tribal", "Acid Punk", "Acid Jazz", "Polka", "Retro", "Musical", "Rock & Roll", "Hard Rock", "Folk",
+	"Folk-Rock", "National Folk", "Swing", "Fast Fusion", "Bebop", "Latin", "Revival", "Celtic", "Bluegrass",
+	"Avantgarde", "Gothic Rock", "Progressive Rock", "Psychedelic Rock", "Symphonic Rock", "Slow Rock",
+	"Big Band", "Chorus", "Easy Listening", "Acoustic", "Humour", "Speech", "Chanson", "Opera", "Chamber Music",
+	"Sonata", "Symphony", "Booty Bass", "Primus", "Porn Groove", "Satire", "Slow Jam", "Club", "Tango", "Samba",
+	"Folklore", "Ballad", "Power Ballad", "Rhythmic Soul", "Freestyle", "Duet", "Punk Rock", "Drum Solo",
+	"A cappella", "Euro-House", "Dance Hall", "Goa", "Drum & Bass", "Club-House", "Hardcore Techno", "Terror",
+	"Indie", "BritPop", "Afro-Punk", "Polsk Punk", "Beat", "Christian Gangsta Rap", "Heavy Metal", "Black Metal",
+	"Crossover", "Contemporary Christian", "Christian Rock", "Merengue", "Salsa", "Thrash Metal", "Anime", "Jpop",
+	"Synthpop",
+}
+
+// variousArtistsNames are the artist names of compilations, whose tracks have their own artists
+var variousArtistsNames = []string{"various artists", "various", "va", "v.a."}
+
+// Tags holds the track metadata found in one source (file and folder names, audio tags or m3u directives)
+type Tags struct {
+	Title      string
+	Artist     string
+	Album      string
+	Genre      string
+	Track      int
+	DiscNumber int
+	Year       int
+	BitRate    int
+	Duration   int
+	// Cover is set if the file has an embedded picture; the picture itself is only kept by ReadCoverArt
+	Cover bool
+	cover []byte
+}
+
+// MergeTags returns the first non-empty value of every field, so sources has to be ordered by precedence
+func MergeTags(sources ...*Tags) *Tags {
+	merged := &Tags{}
+	for _, tags := range sources {
+		if tags == nil {
+			continue
+		}
+		if merged.Title == "" {
+			merged.Title = tags.Title
+		}
+		if merged.Artist == "" {
+			merged.Artist = tags.Artist
+		}
+		if merged.Album == "" {
+			merged.Album = tags.Album
+		}
+		if merged.Genre == "" {
+			merged.Genre = tags.Genre
+		}
+		if merged.Track == 0 {
+			merged.Track = tags.Track
+		}
+		if merged.DiscNumber == 0 {
+			merged.DiscNumber = tags.DiscNumber
+		}
+		if merged.Year == 0 {
+			merged.Year = tags.Year
+		}
+		if merged.BitRate == 0 {
+			merged.BitRate = tags.BitRate
+		}
+		if merged.Duration == 0 {
+			merged.Duration = tags.Duration
+		}
+		if !merged.Cover {
+			merged.Cover, merged.cover = tags.Cover, tags.cover
+		}
+	}
+	return merged
+}
+
+// IsVariousArtists checks that the artist is the placeholder artist of a compilation
+func IsVariousArtists(artist string) bool {
+	return Contains(strings.ToLower(normalizeName(artist)), variousArtistsNames...)
+}
+
+// SplitArtistTitle splits an "Artist - Title" display string; the artist is empty if there is no separator
+func SplitArtistTitle(str string) (string, string) {
+	if parts := strings.SplitN(str, " - ", 2); len(parts) == 2 &&
+		strings.TrimSpace(parts[0]) != "" && strings.TrimSpace(parts[1]) != "" {
+		return strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+	}
+	return "", str
+}
+
+// updateTags merges the tags of the child in the configured order of precedence;
+// the path derived tags are always the last resort
+func (child *Child) updateTags() {
+	sources := map[string]*Tags{
+		TagsSourcePath: child.pathTags,
+		TagsSourceFile: child.fileTags,
+		TagsSourceM3U:  child.m3uTags,
+	}
+	var orderedTags []*Tags
+	for _, source := range Config.TagsPrecedence {
+		orderedTags = append(orderedTags, sources[source])
+	}
+	tags := MergeTags(append(orderedTags, child.pathTags)...)
+	child.Title = tags.Title
+	child.Artist = tags.Artist
+	child.Album = tags.Album
+	child.Genre = tags.Genre
+	child.Track = tags.Track
+	child.DiscNumber = tags.DiscNumber
+	child.Year = tags.Year
+	child.BitRate = tags.BitRate
+	child.Duration = tags.Duration
+}
+
+func ReadTags(filename string) *Tags {
+	file := ProcessErrorArg(os.Open(filename)).(*os.File)
+	defer Close(file)
+	tags, err := readTags(file)
+	if err != nil {
+		log.Printf("Unable to read the tags of %s: %v\n", filename, err)
+	}
+	if tags != nil {
+		tags.cover = nil
+	}
+	return tags
+}
+
+// ReadCoverArt returns the embedded picture of the media file, preferring the front cover, or nil if it has none
+func ReadCoverArt(filename string) []byte {
+	file := ProcessErrorArg(os.Open(filename)).(*os.File)
+	defer Close(file)
+	tags, err := readTags(file)
+	if err != nil {
+		log.Printf("Unable to read the tags of %s: %v\n", filename, err)
+	}
+	if tags == nil {
+		return nil
+	}
+	return tags.cover
+}
+
+func readTags(reader io.ReadSeeker) (*Tags, error) {
+	var (
+		tagList []*Tags
+		offset  int64
+		header  = make([]byte, 12)
+	)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, nil
+	}
+	if bytes.HasPrefix(header, []byte("ID3")) {
+		tags, size, err := readID3v2(reader)
+		if err != nil {
+			return nil, err
+		}
+		tagList, offset = append(tagList, tags), size
+		if _, err := reader.Seek(offset, io.SeekStart); err != nil {
+			return nil, err
+		} else if _, err := io.ReadFull(reader, header); err != nil {
+			return MergeTags(tagList...), nil
+		}
+	}
+	var (
+		tags *Tags
+		err  error
+	)
+	switch {
+	case bytes.HasPrefix(header, []byte("fLaC")):
+		tags, err = readFlacTags(reader, offset)
+	case bytes.HasPrefix(header, []byte("OggS")):
+		tags, err = readOggTags(reader, offset)
+	case bytes.Equal(header[4:8], []byte("ftyp")):
+		tags, err = readMP4Tags(reader)
+	}
+	if err != nil {
+		return nil, err
+	}
+	apeTags, id3v1Tags, err := readTrailingTags(reader)
+	return MergeTags(append(tagList, tags, apeTags, id3v1Tags)...), err
+}
+
+// ID3v2 specification: https://id3.org/id3v2.4.0-structure
+func readID3v2(reader io.ReadSeeker) (*Tags, int64, error) {
+	header := make([]byte, 10)
+	if _, err := reader.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, err
+	} else if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, 0, err
+	}
+	version, flags, size := header[3], header[5], syncsafeInt(header[6:10])
+	tagSize := int64(10 + size)
+	if flags&0x10 != 0 {
+		tagSize += 10
+	}
+	if version < 2 || version > 4 {
+		return nil, tagSize, NewError("unsupported ID3v2.%d tag", version)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, tagSize, err
+	}
+	if flags&0x80 != 0 && version < 4 {
+		body = removeUnsynchronisation(body)
+	}
+	pos := 0
+	if flags&0x40 != 0 && version > 2 && len(body) >= 4 {
+		if version == 3 {
+			pos = 4 + int(binary.BigEndian.Uint32(body))
+		} else {
+			pos = syncsafeInt(body[:4])
+		}
+	}
+	idSize, headerSize := 4, 10
+	if version == 2 {
+		idSize, headerSize = 3, 6
+	}
+	tags := &Tags{}
+	for pos >= 0 && pos+headerSize <= len(body) && body[pos] != 0 {
+		var (
+			frameId    = string(body[pos : pos+idSize])
+			frameSize  int
+			frameFlags uint16
+		)
+		switch version {
+		case 2:
+			frameSize = int(body[pos+3])<<16 | int(body[pos+4])<<8 | int(body[pos+5])
+		case 3:
+			frameSize = int(binary.BigEndian.Uint32(body[pos+4:]))
+			frameFlags = binary.BigEndian.Uint16(body[pos+8:])
+		case 4:
+			frameSize = syncsafeInt(body[pos+4 : pos+8])
+			frameFlags = binary.BigEndian.Uint16(body[pos+8:])
+		}
+		pos += headerSize
+		if frameSize < 0 || pos+frameSize > len(body) {
+			break
+		}
+		if data, ok := id3v2FrameData(version, frameFlags, flags&0x80 != 0, body[pos:pos+frameSize]); ok {
+			tags.setID3v2Frame(frameId, data)
+		}
+		pos += frameSize
+	}
+	return tags, tagSize, nil
+}
+
+func id3v2FrameData(version byte, frameFlags uint16, unsynchronised bool, data []byte) ([]byte, bool) {
+	var compressed bool
+	switch version {
+	case 3:
+		if frameFlags&0x40 != 0 {
+			return nil, false
+		}
+		if compressed = frameFlags&0x80 != 0; compressed && len(data) >= 4 {
+			data = data[4:]
+		}
+		if frameFlags&0x20 != 0 && len(data) >= 1 {
+			data = data[1:]
+		}
+	case 4:
+		if frameFlags&0x04 != 0 {
+			return nil, false
+		}
+		if frameFlags&0x40 != 0 && len(data) >= 1 {
+			data = data[1:]
+		}
+		if frameFlags&0x01 != 0 && len(data) >= 4 {
+			data = data[4:]
+		}
+		if unsynchronised || frameFlags&0x02 != 0 {
+			data = removeUnsynchronisation(data)
+		}
+		compressed = frameFlags&0x08 != 0
+	}
+	if compressed {
+		zlibReader, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, false
+		}
+		defer Close(zlibReader)
+		if data, err = ioutil.ReadAll(zlibReader); err != nil {
+			return nil, false
+		}
+	}
+	return data, true
+}
+
+func (tags *Tags) setID3v2Frame(frameId string, data []byte) {
+	if (frameId == "APIC" || frameId == "PIC") && len(data) > 0 {
+		tags.setID3v2Picture(frameId, data)
+	}
+	if len(data) == 0 || (frameId[0] != 'T' || frameId == "TXXX" || frameId == "TXX") {
+		return
+	}
+	values := decodeID3v2Strings(data[0], data[1:])
+	if len(values) == 0 {
+		return
+	}
+	switch frameId {
+	case "TIT2", "TT2":
+		tags.Title = strings.Join(values, "; ")
+	case "TPE1", "TP1":
+		tags.Artist = strings.Join(values, "; ")
+	case "TALB", "TAL":
+		tags.Album = strings.Join(values, "; ")
+	case "TRCK", "TRK":
+		tags.Track = parseNumberOf(values[0])
+	case "TPOS", "TPA":
+		tags.DiscNumber = parseNumberOf(values[0])
+	case "TYER", "TYE", "TDRC":
+		tags.Year = parseYear(values[0])
+	case "TDOR", "TORY", "TOR":
+		if tags.Year == 0 {
+			tags.Year = parseYear(values[0])
+		}
+	case "TCON", "TCO":
+		var genres []string
+		for _, value := range values {
+			genres = append(genres, parseID3Genres(value)...)
+		}
+		tags.Genre = strings.Join(genres, "; ")
+	}
+}
+
+// setID3v2Picture reads an attached picture frame: encoding, MIME type (v2.3+) or image format (v2.2),
+// picture type, description, picture data
+func (tags *Tags) setID3v2Picture(frameId string, data []byte) {
+	encoding, pos := data[0], 1
+	if frameId == "PIC" {
+		pos += 3
+	} else if end := bytes.IndexByte(data[pos:], 0); end >= 0 {
+		pos += end + 1
+	} else {
+		return
+	}
+	if pos >= len(data) {
+		return
+	}
+	pictureType := data[pos]
+	_, picture := decodeID3v2String(encoding, data[pos+1:])
+	tags.setCover(int(pictureType), picture)
+}
+
+// setCover keeps the first embedded picture, unless a front cover comes later
+func (tags *Tags) setCover(pictureType int, picture []byte) {
+	if len(picture) > 0 && (!tags.Cover || pictureType == 3) {
+		tags.Cover, tags.cover = true, picture
+	}
+}
+
+// decodeID3v2Strings splits the null terminated strings of a text frame
+func decodeID3v2Strings(encoding byte, data []byte) []string {
+	var values []string
+	for len(data) > 0 {
+		var value string
+		value, data = decodeID3v2String(encoding, data)
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// decodeID3v2String decodes the first null terminated string and returns the remaining data
+func decodeID3v2String(encoding byte, data []byte) (string, []byte) {
+	switch encoding {
+	case 1, 2:
+		end := 0
+		for end+1 < len(data) && (data[end] != 0 || data[end+1] != 0) {
+			end += 2
+		}
+		text, rest := data[:Min(end, len(data))], data[Min(end+2, len(data)):]
+		var byteOrder binary.ByteOrder = binary.BigEndian
+		if len(text) >= 2 && text[0] == 0xff && text[1] == 0xfe {
+			byteOrder, text = binary.LittleEndian, text[2:]
+		} else if len(text) >= 2 && text[0] == 0xfe && text[1] == 0xff {
+			text = text[2:]
+		} else if encoding == 1 {
+			byteOrder = binary.LittleEndian
+		}
+		return decodeUTF16(text, byteOrder), rest
+	default:
+		end := bytes.IndexByte(data, 0)
+		if end < 0 {
+			end = len(data)
+		}
+		text, rest := data[:end], data[Min(end+1, len(data)):]
+		if encoding == 0 {
+			return decodeLatin1(text), rest
+		}
+		return string(text), rest
+	}
+}
+
+func decodeUTF16(data []byte, byteOrder binary.ByteOrder) string {
+	codes := make([]uint16, len(data)/2)
+	for i := range codes {
+		codes[i] = byteOrder.Uint16(data[2*i:])
+	}
+	return string(utf16.Decode(codes))
+}
+
+func decodeLatin1(data []byte) string {
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
+
+// parseID3Genres resolves the "(17)", "(17)Rock", "17" and "(RX)" style genre references
+func parseID3Genres(value string) []string {
+	var genres []string
+	for strings.HasPrefix(value, "(") && !strings.HasPrefix(value, "((") {
+		end := strings.Index(value, ")")
+		if end < 0 {
+			break
+		}
+		if genre := id3GenreReference(value[1:end]); genre != "" {
+			genres = append(genres, genre)
+		}
+		value = value[end+1:]
+	}
+	value = strings.TrimSpace(strings.TrimPrefix(value, "("))
+	if genre := id3GenreReference(value); genre != "" {
+		value = genre
+	}
+	if value != "" && (len(genres) == 0 || genres[len(genres)-1] != value) {
+		genres = append(genres, value)
+	}
+	return genres
+}
+
+func id3GenreReference(reference string) string {
+	switch reference {
+	case "RX":
+		return "Remix"
+	case "CR":
+		return "Cover"
+	}
+	if index, err := strconv.Atoi(reference); err == nil && index >= 0 && index < len(id3v1Genres) {
+		return id3v1Genres[index]
+	}
+	return ""
+}
+
+func syncsafeInt(data []byte) int {
+	return int(data[0]&0x7f)<<21 | int(data[1]&0x7f)<<14 | int(data[2]&0x7f)<<7 | int(data[3]&0x7f)
+}
+
+func removeUnsynchronisation(data []byte) []byte {
+	result := make([]byte, 0, len(data))
+	for i := 0; i < len(data); i++ {
+		result = append(result, data[i])
+		if data[i] == 0xff && i+1 < len(data) && data[i+1] == 0x00 {
+			i++
+		}
+	}
+	return result
+}
+
+// readTrailingTags reads the APEv2 and ID3v1 tags from the end of the file
+func readTrailingTags(reader io.ReadSeeker) (*Tags, *Tags, error) {
+	var apeTags, id3v1Tags *Tags
+	end, err := reader.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, nil, err
+	}
+	if end >= 128 {
+		trailer := make([]byte, 128)
+		if _, err := reader.Seek(end-128, io.SeekStart); err != nil {
+			return nil, nil, err
+		} else if _, err := io.ReadFull(reader, trailer); err != nil {
+			return nil, nil, err
+		}
+		if bytes.HasPrefix(trailer, []byte("TAG")) {
+			id3v1Tags, end = readID3v1(trailer), end-128
+		}
+	}
+	if end >= 32 {
+		footer := make([]byte, 32)
+		if _, err := reader.Seek(end-32, io.SeekStart); err != nil {
+			return nil, nil, err
+		} else if _, err := io.ReadFull(reader, footer); err != nil {
+			return nil, nil, err
+		}
+		if bytes.HasPrefix(footer, []byte("APETAGEX")) {
+			if apeTags, err = readAPE(reader, end-32, footer); err != nil {
+				return nil, id3v1Tags, err
+			}
+		}
+	}
+	return apeTags, id3v1Tags, nil
+}
+
+func readID3v1(trailer []byte) *Tags {
+	field := func(data []byte) string {
+		if end := bytes.IndexByte(data, 0); end >= 0 {
+			data = data[:end]
+		}
+		return strings.TrimSpace(decodeLatin1(data))
+	}
+	tags := &Tags{
+		Title:  field(trailer[3:33]),
+		Artist: field(trailer[33:63]),
+		Album:  field(trailer[63:93]),
+		Year:   parseYear(field(trailer[93:97])),
+		Genre:  id3GenreReference(strconv.Itoa(int(trailer[127]))),
+	}
+	if trailer[125] == 0 && trailer[126] != 0 {
+		tags.Track = int(trailer[126])
+	}
+	return tags
+}
+
+// APEv2 specification: https://wiki.hydrogenaud.io/index.php?title=APEv2_specification
+func readAPE(reader io.ReadSeeker, footerOffset int64, footer []byte) (*Tags, error) {
+	size := int64(binary.LittleEndian.Uint32(footer[12:]))
+	itemCount := int(binary.LittleEndian.Uint32(footer[16:]))
+	if size < 32 || size-32 > footerOffset {
+		return nil, NewError("invalid APEv2 tag")
+	}
+	items := make([]byte, size-32)
+	if _, err := reader.Seek(footerOffset+32-size, io.SeekStart); err != nil {
+		return nil, err
+	} else if _, err := io.ReadFull(reader, items); err != nil {
+		return nil, err
+	}
+	comments := make(map[string][]string)
+	for i, pos := 0, 0; i < itemCount && pos+8 < len(items); i++ {
+		valueSize := int(binary.LittleEndian.Uint32(items[pos:]))
+		itemFlags := binary.LittleEndian.Uint32(items[pos+4:])
+		keyEnd := bytes.IndexByte(items[pos+8:], 0)
+		if keyEnd < 0 || valueSize < 0 || pos+8+keyEnd+1+valueSize > len(items) {
+			return nil, NewError("invalid APEv2 tag item")
+		}
+		key := strings.ToUpper(string(items[pos+8 : pos+8+keyEnd]))
+		value := items[pos+8+keyEnd+1 : pos+8+keyEnd+1+valueSize]
+		if itemFlags&0x06 == 0 {
+			comments[key] = append(comments[key], strings.Split(string(value), "\x00")...)
+		}
+		pos += 8 + keyEnd + 1 + valueSize
+	}
+	return tagsFromComments(comments), nil
+}
+
+// Vorbis comment specification: https://www.xiph.org/vorbis/doc/v-comment.html
+func readVorbisComment(data []byte) (*Tags, error) {
+	if len(data) < 8 {
+		return nil, NewError("invalid Vorbis comment")
+	}
+	pos := 4 + int(binary.LittleEndian.Uint32(data))
+	if pos < 4 || pos+4 > len(data) {
+		return nil, NewError("invalid Vorbis comment")
+	}
+	count := int(binary.LittleEndian.Uint32(data[pos:]))
+	pos += 4
+	comments := make(map[string][]string)
+	for i := 0; i < count && pos+4 <= len(data); i++ {
+		length := int(binary.LittleEndian.Uint32(data[pos:]))
+		pos += 4
+		if length < 0 || pos+length > len(data) {
+			return nil, NewError("invalid Vorbis comment")
+		}
+		if comment := strings.SplitN(string(data[pos:pos+length]), "=", 2); len(comment) == 2 {
+			key := strings.ToUpper(comment[0])
+			comments[key] = append(comments[key], comment[1])
+		}
+		pos += length
+	}
+	tags := tagsFromComments(comments)
+	for _, value := range comments["METADATA_BLOCK_PICTURE"] {
+		if block, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value)); err == nil {
+			tags.setCover(readFlacPicture(block))
+		}
+	}
+	return tags, nil
+}
+
+// tagsFromComments maps Vorbis comment and APEv2 item keys to tags
+func tagsFromComments(comments map[string][]string) *Tags {
+	first := func(keys ...string) string {
+		for _, key := range keys {
+			for _, value := range comments[key] {
+				if value = strings.TrimSpace(value); value != "" {
+					return value
+				}
+			}
+		}
+		return ""
+	}
+	var genres []string
+	for _, genre := range comments["GENRE"] {
+		if genre = strings.TrimSpace(genre); genre != "" {
+			genres = append(genres, genre)
+		}
+	}
+	tags := &Tags{
+		Title:      first("TITLE"),
+		Artist:     first("ARTIST"),
+		Album:      first("ALBUM"),
+		Genre:      strings.Join(genres, "; "),
+		Track:      parseNumberOf(first("TRACKNUMBER", "TRACK")),
+		DiscNumber: parseNumberOf(first("DISCNUMBER", "DISC")),
+		Year:       parseYear(first("DATE", "YEAR", "ORIGINALDATE", "ORIGINALYEAR")),
+	}
+	return tags
+}
+
+// FLAC format specification: https://xiph.org/flac/format.html
+func readFlacTags(reader io.ReadSeeker, offset int64) (*Tags, error) {
+	var (
+		tags        *Tags
+		pictureType int
+		picture     []byte
+	)
+	err := forEachFlacMetadataBlock(reader, offset, func(blockType byte, length int) error {
+		if blockType != 4 && (blockType != 6 || picture != nil && pictureType == 3) {
+			return nil
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return err
+		}
+		if blockType == 6 {
+			if blockPictureType, blockPicture := readFlacPicture(data); picture == nil || blockPictureType == 3 {
+				pictureType, picture = blockPictureType, blockPicture
+			}
+			return nil
+		}
+		var err error
+		tags, err = readVorbisComment(data)
+		return err
+	})
+	if picture != nil {
+		if tags == nil {
+			tags = &Tags{}
+		}
+		tags.setCover(pictureType, picture)
+	}
+	return tags, err
+}
+
+// readFlacPicture returns the picture type and the picture data of a PICTURE metadata block, which is also
+// the content of the METADATA_BLOCK_PICTURE Vorbis comment
+func readFlacPicture(block []byte) (int, []byte) {
+	pos := 4
+	for i := 0; i < 2; i++ {
+		if pos+4 > len(block) {
+			return 0, nil
+		}
+		pos += 4 + int(binary.BigEndian.Uint32(block[pos:]))
+	}
+	if pos += 16; pos < 0 || pos+4 > len(block) {
+		return 0, nil
+	}
+	length := int(binary.BigEndian.Uint32(block[pos:]))
+	if pos += 4; length < 0 || pos+length > len(block) {
+		return 0, nil
+	}
+	return int(binary.BigEndian.Uint32(block)), block[pos : pos+length]
+}
+
+// forEachFlacMetadataBlock calls visit with the reader positioned at the start of each block's data
+func forEachFlacMetadataBlock(reader io.ReadSeeker, offset int64, visit func(blockType byte, length int) error) error {
+	pos := offset + 4
+	header := make([]byte, 4)
+	for {
+		if _, err := reader.Seek(pos, io.SeekStart); err != nil {
+			return err
+		} else if _, err := io.ReadFull(reader, header); err != nil {
+			return err
+		}
+		length := int(header[1])<<16 | int(header[2])<<8 | int(header[3])
+		if err := visit(header[0]&0x7f, length); err != nil {
+			return err
+		}
+		if header[0]&0x80 != 0 {
+			return nil
+		}
+		pos += 4 + int64(length)
+	}
+}
+
+// Ogg encapsulation: https://xiph.org/ogg/doc/framing.html
+func readOggTags(reader io.ReadSeeker, offset int64) (*Tags, error) {
+	packets, err := readOggPackets(reader, offset, 2)
+	if err != nil {
+		return nil, err
+	} else if len(packets) < 2 {
+		return nil, NewError("missing Ogg comment header")
+	}
+	identification, comment := packets[0], packets[1]
+	switch {
+	case bytes.HasPrefix(identification, []byte("\x01vorbis")) && bytes.HasPrefix(comment, []byte("\x03vorbis")):
+		tags, err := readVorbisComment(comment[7:])
+		if err == nil && len(identification) >= 24 {
+			if nominalBitRate := int32(binary.LittleEndian.Uint32(identification[20:])); nominalBitRate > 0 {
+				tags.BitRate = int(nominalBitRate / 1000)
+			}
+		}
+		return tags, err
+	case bytes.HasPrefix(identification, []byte("OpusHead")) && bytes.HasPrefix(comment, []byte("OpusTags")):
+		return readVorbisComment(comment[8:])
+	case bytes.HasPrefix(identification, []byte("\x7fFLAC")) && len(comment) >= 4 && comment[0]&0x7f == 4:
+		return readVorbisComment(comment[4:])
+	}
+	return nil, nil
+}
+
+// readOggPackets reassembles the first packets of the first logical bitstream
+func readOggPackets(reader io.ReadSeeker, offset int64, count int) ([][]byte, error) {
+	var (
+		packets [][]byte
+		packet  []byte
+		serial  uint32
+		header  = make([]byte, 27)
+	)
+	if _, err := reader.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	for page := 0; len(packets) < count; page++ {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return packets, nil
+		} else if !bytes.HasPrefix(header, []byte("OggS")) {
+			return packets, NewError("invalid Ogg page")
+		}
+		segments := make([]byte, header[26])
+		if _, err := io.ReadFull(reader, segments); err != nil {
+			return packets, err
+		}
+		pageSize := 0
+		for _, segment := range segments {
+			pageSize += int(segment)
+		}
+		data := make([]byte, pageSize)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return packets, err
+		}
+		if page == 0 {
+			serial = binary.LittleEndian.Uint32(header[14:])
+		} else if binary.LittleEndian.Uint32(header[14:]) != serial {
+			continue
+		}
+		pos := 0
+		for _, segment := range segments {
+			packet = append(packet, data[pos:pos+int(segment)]...)
+			pos += int(segment)
+			if segment < 255 {
+				packets, packet = append(packets, packet), nil
+				if len(packets) == count {
+					break
+				}
+			}
+		}
+	}
+	return packets, nil
+}
+
+// MP4 file format: https://developer.apple.com/documentation/quicktime-file-format
+func readMP4Tags(reader io.ReadSeeker) (*Tags, error) {
+	tags := &Tags{}
+	size, err := reader.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	ilstStart, ilstEnd, err := findMP4Box(reader, 0, size, "moov", "udta", "meta", "ilst")
+	if err == nil && ilstEnd == 0 {
+		ilstStart, ilstEnd, err = findMP4Box(reader, 0, size, "moov", "meta", "ilst")
+	}
+	if err != nil || ilstEnd == 0 {
+		return nil, err
+	}
+	err = forEachMP4Box(reader, ilstStart, ilstEnd, func(itemType string, start, end int64) error {
+		return forEachMP4Box(reader, start, end, func(boxType string, start, end int64) error {
+			if boxType != "data" || end-start < 8 || end-start > 1<<16 && (itemType != "covr" || end-start > 1<<24) {
+				return nil
+			}
+			data := make([]byte, end-start)
+			if _, err := reader.Seek(start, io.SeekStart); err != nil {
+				return err
+			} else if _, err := io.ReadFull(reader, data); err != nil {
+				return err
+			}
+			tags.setMP4Item(itemType, data[8:])
+			return nil
+		})
+	})
+	return tags, err
+}
+
+func (tags *Tags) setMP4Item(itemType string, value []byte) {
+	switch itemType {
+	case "\xa9nam":
+		tags.Title = strings.TrimSpace(string(value))
+	case "\xa9ART":
+		tags.Artist = strings.TrimSpace(string(value))
+	case "\xa9alb":
+		tags.Album = strings.TrimSpace(string(value))
+	case "\xa9day":
+		tags.Year = parseYear(string(value))
+	case "\xa9gen":
+		tags.Genre = strings.TrimSpace(string(value))
+	case "gnre":
+		if len(value) >= 2 && tags.Genre == "" {
+			tags.Genre = id3GenreReference(strconv.Itoa(int(binary.BigEndian.Uint16(value)) - 1))
+		}
+	case "trkn":
+		if len(value) >= 4 {
+			tags.Track = int(binary.BigEndian.Uint16(value[2:]))
+		}
+	case "disk":
+		if len(value) >= 4 {
+			tags.DiscNumber = int(binary.BigEndian.Uint16(value[2:]))
+		}
+	case "covr":
+		tags.setCover(3, value)
+	}
+}
+
+// findMP4Box returns the content boundaries of the box on the given path, or zeros if it does not exist
+func findMP4Box(reader io.ReadSeeker, start, end int64, path ...string) (int64, int64, error) {
+	for _, boxType := range path {
+		found := false
+		err := forEachMP4Box(reader, start, end, func(childType string, childStart, childEnd int64) error {
+			if !found && childType == boxType {
+				if start, end, found = childStart, childEnd, true; boxType == "meta" {
+					start += 4
+				}
+			}
+			return nil
+		})
+		if err != nil || !found {
+			return 0, 0, err
+		}
+	}
+	return start, end, nil
+}
+
+func forEachMP4Box(reader io.ReadSeeker, start, end int64, visit func(boxType string, start, end int64) error) error {
+	header := make([]byte, 16)
+	for pos := start; pos+8 <= end; {
+		if _, err := reader.Seek(pos, io.SeekStart); err != nil {
+			return err
+		} else if _, err := io.ReadFull(reader, header[:8]); err != nil {
+			return err
+		}
+		size, headerSize := int64(binary.BigEndian.Uint32(header)), int64(8)
+		if size == 1 {
+			if _, err := io.ReadFull(reader, header[8:]); err != nil {
+				return err
+			}
+			size, headerSize = int64(binary.BigEndian.Uint64(header[8:])), 16
+		} else if size == 0 {
+			size = end - pos
+		}
+		if size < headerSize || pos+size > end {
+			return NewError("invalid MP4 box: %q", header[4:8])
+		}
+		if err := visit(string(header[4:8]), pos+headerSize, pos+size); err != nil {
+			return err
+		}
+		pos += size
+	}
+	return nil
+}
+
+// parseNumberOf parses the "3" of "3/12"
+func parseNumberOf(value string) int {
+	if number, err := strconv.Atoi(strings.TrimSpace(strings.SplitN(value, "/", 2)[0])); err == nil {
+		return number
+	}
+	return 0
+}
+
+func parseYear(value string) int {
+	if value = strings.TrimSpace(value); len(value) >= 4 {
+		if year, err := strconv.Atoi(value[:4]); err == nil {
+			return year
+		}
+	}
+	return 0
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io"
+	"log"
+	"mime"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FindTranscoding returns the first transcoding which produces the requested format, or which is needed to keep
+// the bitrate under the limit; the returned transcoding is nil if the file can be streamed as it is
+func FindTranscoding(suffix string, bitRate int, format string, maxBitRate int) (*TranscodingConfig, int) {
+	overLimit := maxBitRate > 0 && (bitRate == 0 || bitRate > maxBitRate)
+	if format == "raw" || (format == "" || format == suffix) && !overLimit {
+		return nil, 0
+	}
+	for _, transcoding := range Config.Transcodings {
+		if !Contains(suffix, transcoding.From...) && !Contains("*", transcoding.From...) {
+			continue
+		}
+		if format != "" && format != transcoding.Format {
+			continue
+		}
+		targetBitRate := transcoding.BitRate
+		if maxBitRate > 0 && (targetBitRate == 0 || targetBitRate > maxBitRate) {
+			targetBitRate = maxBitRate
+		}
+		return transcoding, targetBitRate
+	}
+	return nil, 0
+}
+
+// SendTranscoded streams the standard output of the transcoding command; the command is killed when the client
+// disconnects
+func (exchange Exchange) SendTranscoded(filename string, transcoding *TranscodingConfig,
+	bitRate int, timeOffset int, contentLength int64) {
+	replacer := strings.NewReplacer(
+		"{file}", filename, "{bitrate}", strconv.Itoa(bitRate), "{offset}", strconv.Itoa(timeOffset))
+	var args []string
+	for _, arg := range transcoding.Command {
+		args = append(args, replacer.Replace(arg))
+	}
+	command := exec.CommandContext(exchange.Request.Context(), args[0], args[1:]...)
+	stdout := ProcessErrorArg(command.StdoutPipe()).(io.ReadCloser)
+	ProcessError(command.Start())
+	exchange.responseWriter.Header().Set("Content-Type", mime.TypeByExtension("."+transcoding.Format))
+	if contentLength > 0 {
+		exchange.responseWriter.Header().Set("Content-Length", strconv.FormatInt(contentLength, 10))
+	}
+	n, err := io.Copy(exchange.responseWriter, stdout)
+	if err := command.Wait(); err != nil && exchange.Request.Context().Err() == nil {
+		log.Printf("Transcoding of %s failed: %v\n", filename, err)
+	}
+	ProcessError(err)
+	log.Printf("Response (%d bytes, %v): transcoded (%s, %d kbps): %s",
+		n, time.Since(exchange.requestTime), transcoding.Format, bitRate, filename)
+}
+
+// EstimateContentLength returns the expected size of a transcoded stream
+func EstimateContentLength(duration int, bitRate int) int64 {
+	return int64(duration) * int64(bitRate) * 1000 / 8
+}
@@ -6,9 +6,11 @@ import (
 	"fmt"
 	"hash/fnv"
 	"io"
+	"io/ioutil"
 	"log"
 	"math"
 	"math/rand"
+	"mime"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -97,6 +99,13 @@ func Min(x, y int) int {
 	return x
 }
 
+func Max(x, y int) int {
+	if x < y {
+		return y
+	}
+	return x
+}
+
 func IsExists(path string) bool {
 	exists := false
 	if _, err := os.Stat(path); err == nil {
@@ -107,6 +116,22 @@ func IsExists(path string) bool {
 	return exists
 }
 
+// WriteFileAtomic writes the data into a temporary file next to the target and renames it over the target,
+// so a crash never leaves a truncated file behind
+func WriteFileAtomic(filename string, data []byte) {
+	file := ProcessErrorArg(ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".*")).(*os.File)
+	defer func() {
+		if IsExists(file.Name()) {
+			ProcessError(os.Remove(file.Name()))
+		}
+	}()
+	ProcessErrorArg(file.Write(data))
+	ProcessError(file.Sync())
+	Close(file)
+	ProcessError(os.Chmod(file.Name(), 0644))
+	ProcessError(os.Rename(file.Name(), filename))
+}
+
 func IsAllowedPath(path string) (string, error) {
 	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
 		return path, nil
@@ -152,6 +177,14 @@ type PathInfo struct {
 	os.FileInfo
 }
 
+func (pathInfo *PathInfo) Path() string {
+	return pathInfo.Parent + PathSeparator + pathInfo.Name()
+}
+
+func GetPathInfo(path string) *PathInfo {
+	return NewPathInfo(DirName(path), GetFileInfo(path))
+}
+
 func GetFileInfo(path string) os.FileInfo {
 	return ProcessErrorArg(os.Stat(path)).(os.FileInfo)
 }
@@ -238,6 +271,12 @@ func (pathInfoList *PathInfoList) FilterByChild(filter func(*Child) bool) *PathI
 	return pathInfoList
 }
 
+func (pathInfoList *PathInfoList) Page(offset, size int) *PathInfoList {
+	offset = Max(Min(offset, len(*pathInfoList)), 0)
+	*pathInfoList = (*pathInfoList)[offset:Min(offset+Max(size, 0), len(*pathInfoList))]
+	return pathInfoList
+}
+
 func (pathInfoList *PathInfoList) Shuffle() *PathInfoList {
 	rand.Seed(time.Now().UnixNano())
 	rand.Shuffle(len(*pathInfoList), func(i, j int) {
@@ -279,16 +318,47 @@ var (
 	childCacheMutex = sync.RWMutex{}
 )
 
+// InvalidateChildCache drops the cached children of the path and of its content
+func InvalidateChildCache(path string) {
+	childCacheMutex.Lock()
+	defer childCacheMutex.Unlock()
+	for childPath := range childCache {
+		if childPath == path || strings.HasPrefix(childPath, path+PathSeparator) {
+			delete(childCache, childPath)
+		}
+	}
+}
+
+// BuildChild returns the child of the file or folder from the library index, or builds it from the disk
+// if it is not indexed yet
 func BuildChild(entry *PathInfo) *Child {
 	childPath := entry.Parent + PathSeparator + entry.Name()
-	if child, ok := func() (child *Child, ok bool) {
+	if child := Library.Child(childPath); child != nil {
+		return child
+	} else if child, ok := func() (child *Child, ok bool) {
 		childCacheMutex.RLock()
 		defer childCacheMutex.RUnlock()
 		child, ok = childCache[childPath]
 		return
 	}(); ok && child.Changed.Equal(ChangeTime(childPath).Time) {
-		return child
+		childCopy := *child
+		return &childCopy
+	}
+	var fileTags *Tags
+	if !entry.IsDir() && Contains(filepath.Ext(entry.Name()), mediaFileExtensions...) {
+		fileTags = Library.FileTags(childPath, entry)
 	}
+	child := buildChild(entry, fileTags)
+	childCacheMutex.Lock()
+	defer childCacheMutex.Unlock()
+	childCache[childPath] = child
+	childCopy := *child
+	return &childCopy
+}
+
+// buildChild builds the child from the names of the path, the file tags and the cover images on the disk
+func buildChild(entry *PathInfo, fileTags *Tags) *Child {
+	childPath := entry.Parent + PathSeparator + entry.Name()
 	child := Child{
 		Id:      EncodeId(childPath),
 		IsDir:   entry.IsDir(),
@@ -297,45 +367,147 @@ func BuildChild(entry *PathInfo) *Child {
 		Changed: ChangeTime(childPath),
 	}
 	childPathParts := getChildPathParts(childPath)
-	if len(childPathParts) > 0 && childPathParts[0].IsDir() {
-		child.Artist = normalizeName(childPathParts[0].Name())
-		if len(childPathParts) == 1 {
-			child.Title = child.Artist
-		}
+	layout := GetLayout(childPath)
+	pathTags, title := layout.Match(childPathParts)
+	child.Title = title
+	child.Artist = pathTags.Artist
+	child.Album = pathTags.Album
+	child.Genre = pathTags.Genre
+	child.Track = pathTags.Track
+	child.DiscNumber = pathTags.DiscNumber
+	child.Year = pathTags.Year
+	if layout.artistDepth > 0 && len(childPathParts) > layout.artistDepth {
+		child.ArtistId = EncodeId(getChildPathPrefix(childPath, layout.artistDepth))
+	}
+	if layout.albumDepth > 0 && len(childPathParts) > layout.albumDepth {
+		child.AlbumId = EncodeId(getChildPathPrefix(childPath, layout.albumDepth))
 	}
-	if len(childPathParts) > 1 {
+	if len(childPathParts) > 1 && child.IsDir {
 		child.Parent = EncodeId(entry.Parent)
-		if childPathParts[1].IsDir() {
-			child.Album = normalizeName(childPathParts[1].Name())
-			if match := leadingYearRegexp.FindStringSubmatch(child.Album); match != nil {
-				child.Album = match[2]
-				child.Year = int(ParseNumber(match[1]))
-			}
-			if len(childPathParts) == 2 {
-				child.Title = child.Album
-			}
-		}
+	} else if len(childPathParts) > 1 {
+		child.Parent = EncodeId(AlbumFolder(childPath))
 	}
-	coverArtFile := childPath + PathSeparator + "folder.jpg"
 	if !child.IsDir {
-		coverArtFile = entry.Parent + PathSeparator + "folder.jpg"
 		child.Suffix = strings.Replace(filepath.Ext(entry.Name()), ".", "", 1)
+		child.ContentType = mime.TypeByExtension(filepath.Ext(entry.Name()))
 		child.Size = entry.Size()
-		child.Title = child.Title[0 : len(child.Title)-len(filepath.Ext(child.Title))]
-		if match := leadingTrackRegexp.FindStringSubmatch(child.Title); match != nil {
-			child.Title = match[2]
-			child.Track = int(ParseNumber(match[1]))
-		}
 	}
-	if IsExists(coverArtFile) {
+	if artist, title := SplitArtistTitle(child.Title); !child.IsDir && artist != "" && IsVariousArtists(child.Artist) {
+		child.Artist = artist
+		child.Title = title
+		pathTags.Artist = artist
+	}
+	pathTags.Title = child.Title
+	child.pathTags = pathTags
+	if !child.IsDir && Contains(filepath.Ext(entry.Name()), mediaFileExtensions...) {
+		child.fileTags = fileTags
+		child.updateTags()
+	}
+	var coverArtFile string
+	if !child.IsDir {
+		coverArtFile = FindCoverFile(AlbumFolder(childPath), Config.CoverFiles)
+	} else if IsArtistFolder(childPath) {
+		coverArtFile = FindArtistImage(childPath)
+	} else {
+		coverArtFile = FindCoverFile(childPath, Config.CoverFiles)
+	}
+	if coverArtFile != "" {
 		child.CoverArt = EncodeId(coverArtFile)
+	} else if child.fileTags != nil && child.fileTags.Cover {
+		child.CoverArt = EncodeId(childPath)
+	} else if child.IsDir && IsAlbumFolder(childPath) {
+		child.CoverArt = embeddedAlbumCoverArt(childPath)
 	}
-	childCacheMutex.Lock()
-	defer childCacheMutex.Unlock()
-	childCache[childPath] = &child
 	return &child
 }
 
+// embeddedAlbumCoverArt returns the id of the first media file of the album with an embedded picture
+func embeddedAlbumCoverArt(directory string) string {
+	for _, entry := range *ReadAlbumFiles(directory).Sort() {
+		if tags := Library.FileTags(entry.Path(), entry); tags != nil && tags.Cover {
+			return EncodeId(entry.Path())
+		}
+	}
+	return ""
+}
+
+func BuildArtistID3(entry *PathInfo) *ArtistID3 {
+	child := BuildChild(entry)
+	return &ArtistID3{
+		Id:         child.Id,
+		Name:       child.Artist,
+		CoverArt:   child.CoverArt,
+		AlbumCount: len(*AlbumFolders(entry.Path())),
+		Starred:    child.Starred,
+	}
+}
+
+func BuildAlbumID3(entry *PathInfo) *AlbumID3 {
+	child := BuildChild(entry)
+	albumID3 := &AlbumID3{
+		Id:        child.Id,
+		Name:      child.Album,
+		Artist:    child.Artist,
+		ArtistId:  child.Parent,
+		CoverArt:  child.CoverArt,
+		SongCount: len(*ReadAlbumFiles(entry.Path())),
+		Created:   child.Created,
+		Starred:   child.Starred,
+		Year:      child.Year,
+		Genre:     child.Genre,
+	}
+	if albumID3.Name == "" {
+		albumID3.Name = child.Title
+	}
+	if playlistFile := entry.Path() + PathSeparator + "album.m3u8"; IsExists(playlistFile) {
+		playlist := ReadPlaylist(playlistFile)
+		albumID3.SongCount = playlist.SongCount
+		albumID3.Duration = Max(playlist.Duration, 0)
+		if playlist.Album != "" {
+			albumID3.Name = playlist.Album
+		}
+		if playlist.Artist != "" {
+			albumID3.Artist = playlist.Artist
+		}
+		if playlist.Year > 0 {
+			albumID3.Year = playlist.Year
+		}
+		if playlist.Genre != "" {
+			albumID3.Genre = playlist.Genre
+		}
+	}
+	return albumID3
+}
+
+// ReadDirectorySongs returns the songs of a directory ordered by disc, in the order of its album.m3u8 file
+// if one exists
+func ReadDirectorySongs(directory string) []*Child {
+	if playlistFile := directory + PathSeparator + "album.m3u8"; IsExists(playlistFile) {
+		return ReadPlaylist(playlistFile).GetPlaylistWithSongs().Entry
+	}
+	var songs []*Child
+	for _, entry := range *ReadAlbumFiles(directory).SortByChild(func(child1, child2 *Child) bool {
+		if child1.DiscNumber != child2.DiscNumber {
+			return child1.DiscNumber < child2.DiscNumber
+		}
+		return filepath.Base(DecodeId(child1.Id)) < filepath.Base(DecodeId(child2.Id))
+	}) {
+		songs = append(songs, BuildChild(entry))
+	}
+	return songs
+}
+
+// ReadAlbumFiles returns the media files of a directory, including the files of the disc subfolders of an album
+func ReadAlbumFiles(directory string) *PathInfoList {
+	files := ReadDir(directory).Filter(false, mediaFileExtensions...)
+	for _, entry := range *ReadDir(directory).Filter(true) {
+		if IsDiscFolder(entry.Path()) {
+			*files = append(*files, *ReadDir(entry.Path()).Filter(false, mediaFileExtensions...)...)
+		}
+	}
+	return files
+}
+
 func getChildPathParts(path string) []os.FileInfo {
 	musicFolderParts := strings.SplitN(path, MusicFolderSeparator, 2)
 	musicDirectoryParts := strings.Split(musicFolderParts[1], PathSeparator)
@@ -348,6 +520,21 @@ func getChildPathParts(path string) []os.FileInfo {
 	return childPathParts
 }
 
+func getChildPathPrefix(path string, depth int) string {
+	musicFolderParts := strings.SplitN(path, MusicFolderSeparator, 2)
+	musicDirectoryParts := strings.SplitN(musicFolderParts[1], PathSeparator, depth+1)
+	return musicFolderParts[0] + MusicFolderSeparator +
+		strings.Join(musicDirectoryParts[:Min(depth, len(musicDirectoryParts))], PathSeparator)
+}
+
+func getChildDepth(path string) int {
+	musicFolderParts := strings.SplitN(path, MusicFolderSeparator, 2)
+	if len(musicFolderParts) < 2 {
+		return 0
+	}
+	return len(strings.Split(musicFolderParts[1], PathSeparator))
+}
+
 func normalizeName(str string) string {
 	return strings.Replace(strings.TrimSpace(str), "_", " ", -1)
 }